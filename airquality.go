@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// airQualityBaseURL is the open-meteo air quality endpoint, overridden by
+// tests.
+var airQualityBaseURL = "https://air-quality-api.open-meteo.com/v1"
+
+// enableAirQuality enables fetching the outside air quality.
+var enableAirQuality bool
+
+// AirQuality is the outside air quality for the current hour. Fields are nil
+// if not reported.
+type AirQuality struct {
+	PM25 *float64 // µg/m³
+	AQI  *float64 // US Air Quality Index
+}
+
+func getAirQuality(ctx context.Context, lat, lon string) (AirQuality, error) {
+	url := fmt.Sprintf("%s/air-quality?latitude=%s&longitude=%s&hourly=pm2_5,us_aqi", airQualityBaseURL, lat, lon)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return AirQuality{}, fmt.Errorf("failed to create air quality request: %w", err)
+	}
+	var rv struct {
+		UTCOffsetSeconds int `json:"utc_offset_seconds"`
+		Hourly           struct {
+			Time  []string   `json:"time"`
+			PM25  []*float64 `json:"pm2_5"`
+			USAQI []*float64 `json:"us_aqi"`
+		} `json:"hourly"`
+	}
+	if err := fetchJSON(req, "air quality", &rv); err != nil {
+		return AirQuality{}, err
+	}
+	i, err := currentHourIndex(rv.Hourly.Time, time.FixedZone("", rv.UTCOffsetSeconds), time.Now())
+	if err != nil {
+		return AirQuality{}, err
+	}
+	return AirQuality{
+		PM25: valueAt(rv.Hourly.PM25, i),
+		AQI:  valueAt(rv.Hourly.USAQI, i),
+	}, nil
+}
+
+// collectAirQuality fetches and records the outside air quality at l. Failures
+// are logged, as the air quality is best-effort.
+func collectAirQuality(ctx context.Context, l weatherLocation) {
+	aq, err := getAirQuality(ctx, l.Lat, l.Lon)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		slog.Warn("failed to get air quality", "location", l.Name, "err", err)
+		return
+	}
+	var ms []stats.Measurement
+	if aq.PM25 != nil {
+		ms = append(ms, outsidePM25.M(*aq.PM25))
+	}
+	if aq.AQI != nil {
+		ms = append(ms, outsideAQI.M(*aq.AQI))
+	}
+	if len(ms) == 0 {
+		slog.Warn("no air quality data found for the current hour", "location", l.Name)
+		return
+	}
+	if err := stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(locationKey, l.Name)}, ms...); err != nil {
+		slog.Warn("failed to record air quality", "location", l.Name, "err", err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+func TestCollectAirQuality(t *testing.T) {
+	registerTestViews(t)
+	var gotQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/air-quality" {
+			http.NotFound(w, r)
+			return
+		}
+		gotQuery = r.URL.RawQuery
+		fmt.Fprintf(w, `{"utc_offset_seconds":0,"hourly":{"time":[%s],"pm2_5":[1.5,8.25,null],"us_aqi":[10,34,50]}}`,
+			openMeteoHours(time.Now(), time.UTC))
+	}))
+	t.Cleanup(srv.Close)
+	setVar(t, &airQualityBaseURL, srv.URL)
+
+	collectAirQuality(context.Background(), weatherLocation{Name: "home", Lat: "47.68", Lon: "-122.38"})
+	if want := "latitude=47.68&longitude=-122.38&hourly=pm2_5,us_aqi"; gotQuery != want {
+		t.Errorf("query = %q, want %q", gotQuery, want)
+	}
+	for name, want := range map[string]float64{"outside_pm25": 8.25, "outside_aqi": 34} {
+		rows, err := view.RetrieveData(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 {
+			t.Fatalf("%s: got %d rows, want 1", name, len(rows))
+		}
+		if tags := rows[0].Tags; len(tags) != 1 || tags[0].Key != locationKey || tags[0].Value != "home" {
+			t.Errorf("%s: tags = %v, want location=home", name, tags)
+		}
+		if got := lastValue(rows[0]); got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestCollectAirQualityMissingHour(t *testing.T) {
+	registerTestViews(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"utc_offset_seconds":0,"hourly":{"time":[%s],"pm2_5":[1,null,3],"us_aqi":[1,null,3]}}`,
+			openMeteoHours(time.Now(), time.UTC))
+	}))
+	t.Cleanup(srv.Close)
+	setVar(t, &airQualityBaseURL, srv.URL)
+	logs := captureLogs(t)
+
+	collectAirQuality(context.Background(), weatherLocation{Name: "home"})
+	for _, name := range []string{"outside_pm25", "outside_aqi"} {
+		if rows, err := view.RetrieveData(name); err != nil || len(rows) != 0 {
+			t.Errorf("%s: got rows %v (err %v), want none", name, rows, err)
+		}
+	}
+	if want := "no air quality data found for the current hour"; !strings.Contains(logs.String(), want) {
+		t.Errorf("logs = %q, want %q", logs, want)
+	}
+}
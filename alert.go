@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// alerts posts room temperature alerts to a webhook, or is nil if WEBHOOK_URL
+// is not set.
+var alerts *alerter
+
+// alertThresholds are the room temperatures, in the configured unit, outside
+// of which an alert is sent. Nil bounds are not checked.
+type alertThresholds struct {
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+}
+
+// or returns t with its unset bounds taken from def.
+func (t alertThresholds) or(def alertThresholds) alertThresholds {
+	if t.Min == nil {
+		t.Min = def.Min
+	}
+	if t.Max == nil {
+		t.Max = def.Max
+	}
+	return t
+}
+
+func (t alertThresholds) validate() error {
+	if t.Min != nil && t.Max != nil && *t.Min >= *t.Max {
+		return fmt.Errorf("min %g must be below max %g", *t.Min, *t.Max)
+	}
+	return nil
+}
+
+// parseAlertRooms parses semicolon-separated "room:min,max" entries, either
+// bound being optional, such as "bedroom:18,26;garage:,35".
+func parseAlertRooms(s string) (map[string]alertThresholds, error) {
+	out := make(map[string]alertThresholds)
+	for i, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		room, bounds, ok := strings.Cut(entry, ":")
+		lo, hi, ok2 := strings.Cut(bounds, ",")
+		if !ok || !ok2 || strings.TrimSpace(room) == "" {
+			return nil, fmt.Errorf("invalid room thresholds %q at position %d: must be room:min,max", entry, i)
+		}
+		var t alertThresholds
+		for _, b := range []struct {
+			s string
+			v **float64
+		}{{lo, &t.Min}, {hi, &t.Max}} {
+			if b.s = strings.TrimSpace(b.s); b.s == "" {
+				continue
+			}
+			f, err := strconv.ParseFloat(b.s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid room thresholds %q at position %d: %q is not a number", entry, i, b.s)
+			}
+			*b.v = &f
+		}
+		out[room] = t
+	}
+	return out, nil
+}
+
+// alerter tracks which devices are out of their thresholds, to alert only
+// when a room crosses one and when it recovers, rather than on every
+// collection.
+type alerter struct {
+	url    string
+	global alertThresholds
+	rooms  map[string]alertThresholds // by lowercase sanitized room name
+
+	mu     sync.Mutex
+	firing map[string]bool // by device ID
+}
+
+func newAlerter(url string, global alertThresholds, rooms map[string]alertThresholds) *alerter {
+	a := &alerter{
+		url:    url,
+		global: global,
+		rooms:  make(map[string]alertThresholds),
+		firing: make(map[string]bool),
+	}
+	for room, t := range rooms {
+		a.rooms[strings.ToLower(sanitizeString(room))] = t
+	}
+	return a
+}
+
+// alertMessage is the JSON body posted to the webhook. Text makes it usable
+// with Slack incoming webhooks.
+type alertMessage struct {
+	Text     string   `json:"text"`
+	State    string   `json:"state"` // "alert" or "recovered"
+	Room     string   `json:"room"`
+	DeviceID string   `json:"device_id"`
+	Temp     float64  `json:"temp"`
+	Unit     tempUnit `json:"unit"`
+	Min      *float64 `json:"min"`
+	Max      *float64 `json:"max"`
+}
+
+// check alerts for each online device whose room temperature got out of its
+// thresholds, and for each whose temperature is back within them. Stale
+// readings are ignored. An alert
+// that fails to send is retried at the next collection.
+func (a *alerter) check(ctx context.Context, devices []DeviceReading) {
+	for _, d := range devices {
+		if !d.Online || d.Stale {
+			continue
+		}
+		room := d.Room
+		t := a.rooms[strings.ToLower(room)].or(a.global)
+		temp := d.Temp
+		var problem string
+		switch {
+		case t.Max != nil && temp > *t.Max:
+			problem = fmt.Sprintf("above %g%s", *t.Max, temperatureUnit)
+		case t.Min != nil && temp < *t.Min:
+			problem = fmt.Sprintf("below %g%s", *t.Min, temperatureUnit)
+		}
+		a.mu.Lock()
+		wasFiring := a.firing[d.DeviceID]
+		a.mu.Unlock()
+		msg := alertMessage{Room: room, DeviceID: d.DeviceID, Temp: temp, Unit: temperatureUnit, Min: t.Min, Max: t.Max}
+		switch {
+		case problem != "" && !wasFiring:
+			msg.State = "alert"
+			msg.Text = fmt.Sprintf("%s is at %g%s, %s", room, temp, temperatureUnit, problem)
+		case problem == "" && wasFiring:
+			msg.State = "recovered"
+			msg.Text = fmt.Sprintf("%s is back to %g%s", room, temp, temperatureUnit)
+		default:
+			continue
+		}
+		if err := a.post(ctx, msg); err != nil {
+			slog.Error("failed to send alert", "device_id", d.DeviceID, "room", room, "state", msg.State, "err", err)
+			continue
+		}
+		slog.Info("sent alert", "device_id", d.DeviceID, "room", room, "state", msg.State, "temp", temp)
+		a.mu.Lock()
+		a.firing[d.DeviceID] = msg.State == "alert"
+		a.mu.Unlock()
+	}
+}
+
+func (a *alerter) post(ctx context.Context, msg alertMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return wrapHTTPError("webhook", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("webhook request failed code=%d error=%s", resp.StatusCode, string(body))
+	}
+	return nil
+}
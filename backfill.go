@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// maxBackfillHours is the longest history Sensibo returns.
+const maxBackfillHours = 7 * 24
+
+// historicalMeasurements are the past readings of a device, oldest first.
+type historicalMeasurements struct {
+	Temperature []historicalPoint `json:"temperature"` // Celsius
+	Humidity    []historicalPoint `json:"humidity"`
+}
+
+type historicalPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// getHistoricalMeasurements fetches the readings of the device over the last
+// days. Returned errors never contain the API key.
+func getHistoricalMeasurements(ctx context.Context, apiKey, deviceID string, days int) (historicalMeasurements, error) {
+	req, err := newSensiboRequest(ctx, http.MethodGet, "/pods/"+url.PathEscape(deviceID)+"/historicalMeasurements",
+		url.Values{"days": {strconv.Itoa(days)}}, apiKey)
+	if err != nil {
+		return historicalMeasurements{}, redactedError{err: fmt.Errorf("failed to create request: %w", err), secret: apiKey}
+	}
+	resp, err := doWithRetry(ctx, httpClient, req, sensiboMaxAttempts, sensiboLimiter, sensiboRequestDuration)
+	if err != nil {
+		return historicalMeasurements{}, redactedError{err: wrapHTTPError("sensibo", err), secret: apiKey}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return historicalMeasurements{}, redactedError{
+			err:    fmt.Errorf("request failed code=%d error=%s", resp.StatusCode, string(body)),
+			secret: apiKey,
+		}
+	}
+	var out struct {
+		Status string                 `json:"status"`
+		Result historicalMeasurements `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return historicalMeasurements{}, fmt.Errorf("failed to decode historical measurements: %w", err)
+	}
+	if out.Status != "success" {
+		return historicalMeasurements{}, fmt.Errorf("unexpected response status=%q", out.Status)
+	}
+	return out.Result, nil
+}
+
+// backfill writes the room temperature and humidity of the last hours before
+// now to the sinks that take timestamped readings: InfluxDB and the CSV file.
+// OpenCensus views only hold current values, so other exporters can't be
+// backfilled. It returns the number of readings written to at least one of
+// the sinks.
+func backfill(ctx context.Context, accounts []sensiboAccount, hours int, now time.Time) (int, error) {
+	since := now.Add(-time.Duration(hours) * time.Hour)
+	days := (hours + 23) / 24
+	var errs []error
+	var written int
+	for _, a := range accounts {
+		devices, err := GetDevices(ctx, a.APIKey)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("account %s: %w", a.Name, err))
+			continue
+		}
+		for _, d := range filterDevices(devices) {
+			d.Account = a.Name
+			h, err := getHistoricalMeasurements(ctx, a.APIKey, d.ID, days)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("device %s: %w", d.ID, err))
+				continue
+			}
+			n, err := writeBackfill(ctx, d, h, since, now)
+			written += n
+			if err != nil {
+				errs = append(errs, fmt.Errorf("device %s: %w", d.ID, err))
+			}
+		}
+	}
+	return written, errors.Join(errs...)
+}
+
+// writeBackfill writes the readings of d between since and now. Points are
+// named after the views, like those the influx exporter writes live, and a
+// sink that fails doesn't keep the readings from the other.
+func writeBackfill(ctx context.Context, d DeviceInfo, h historicalMeasurements, since, now time.Time) (int, error) {
+	inRange := func(p historicalPoint) bool { return p.Time.After(since) && !p.Time.After(now) }
+	room := sanitizeString(d.Room.Name)
+	var lines bytes.Buffer
+	var rows [][]string
+	for _, p := range h.Temperature {
+		if !inRange(p) {
+			continue
+		}
+		temp := temperatureUnit.fromCelsius(p.Value)
+		writeInfluxPoint(&lines, viewName(roomTemp), d, room, temp, p.Time)
+		// The outside temperature and AC state of the time are unknown.
+		rows = append(rows, []string{p.Time.UTC().Format(time.RFC3339), "", room, d.ID, formatFloat(temp), ""})
+	}
+	for _, p := range h.Humidity {
+		if inRange(p) {
+			writeInfluxPoint(&lines, viewName(roomHumidity), d, room, p.Value, p.Time)
+		}
+	}
+	var errs []error
+	var written bool
+	if influx != nil {
+		if err := influx.post(ctx, lines.Bytes()); err != nil {
+			errs = append(errs, err)
+		} else {
+			written = true
+		}
+	}
+	if csvOut != nil {
+		if err := csvOut.writeRows(rows); err != nil {
+			errs = append(errs, err)
+		} else {
+			written = true
+		}
+	}
+	if !written {
+		return 0, errors.Join(errs...)
+	}
+	return len(rows), errors.Join(errs...)
+}
+
+// writeInfluxPoint writes a point of the device-scoped measure name in line
+// protocol, tagged like its view.
+func writeInfluxPoint(b *bytes.Buffer, name string, d DeviceInfo, room string, v float64, t time.Time) {
+	fmt.Fprintf(b, "%s,%s=%s,%s=%s,%s=%s value=%g %d\n", influxEscaper.Replace(name),
+		accountKey.Name(), influxEscaper.Replace(d.Account),
+		deviceIDKey.Name(), influxEscaper.Replace(d.ID),
+		roomKey.Name(), influxEscaper.Replace(room),
+		v, t.Unix())
+}
+
+// logBackfill runs backfill, which is best-effort, logging its outcome.
+func logBackfill(ctx context.Context, accounts []sensiboAccount, hours int) {
+	if influx == nil && csvOut == nil {
+		slog.Warn("backfill requires the influx exporter or CSV_FILE, skipped it")
+		return
+	}
+	n, err := backfill(ctx, accounts, hours, time.Now())
+	if err != nil {
+		slog.Error("backfill failed", "written", n, "err", err)
+		return
+	}
+	slog.Info("backfilled readings", "hours", hours, "written", n)
+}
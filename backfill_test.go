@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+func TestWriteBackfill(t *testing.T) {
+	// A prefix, as when SINKS has prometheus next to influx.
+	if err := registerViews(celsius, true, "home_ac_"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { view.Unregister(views...) })
+	setVar(t, &temperatureUnit, celsius)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var d DeviceInfo
+	d.Account, d.ID, d.Room.Name = "0", "abc", "Living Room"
+	h := historicalMeasurements{
+		Temperature: []historicalPoint{
+			{Time: now.Add(-3 * time.Hour), Value: 20}, // before since
+			{Time: now.Add(-time.Hour), Value: 21.5},
+		},
+		Humidity: []historicalPoint{{Time: now.Add(-time.Hour), Value: 40}},
+	}
+
+	for _, influxDown := range []bool{false, true} {
+		var body string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			body = string(b)
+			if influxDown {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+			}
+		}))
+		defer srv.Close()
+		setVar(t, &influx, newInfluxWriter(srv.URL, "bucket", "", ""))
+		path := filepath.Join(t.TempDir(), "readings.csv")
+		c, err := openCSV(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.close()
+		setVar(t, &csvOut, c)
+
+		n, err := writeBackfill(context.Background(), d, h, now.Add(-2*time.Hour), now)
+		if influxDown != (err != nil) {
+			t.Errorf("influx down=%v: error %v", influxDown, err)
+		}
+		if n != 1 {
+			t.Errorf("influx down=%v: wrote %d readings, want 1", influxDown, n)
+		}
+		ts := strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)
+		for _, want := range []string{
+			"home_ac_room_temp,account=0,device_id=abc,room=Living_Room value=21.5 " + ts,
+			"home_ac_room_humidity,account=0,device_id=abc,room=Living_Room value=40 " + ts,
+		} {
+			if !strings.Contains(body, want+"\n") {
+				t.Errorf("influx body %q does not have %q", body, want)
+			}
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "2024-05-01T11:00:00Z,,Living_Room,abc,21.5,\n"; !strings.HasSuffix(string(b), want) {
+			t.Errorf("influx down=%v: csv file %q does not end with %q", influxDown, b, want)
+		}
+	}
+}
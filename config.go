@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the program configuration. It is loaded from an optional YAML
+// file (CONFIG_FILE), environment variables and flags, in increasing order of
+// precedence. See README.md for the meaning of each field.
+type Config struct {
+	SensiboAPIKeys      []string `yaml:"sensibo_api_keys"`       // SENSIBO_API_KEY
+	SensiboAccountNames []string `yaml:"sensibo_account_names"`  // SENSIBO_ACCOUNT_NAMES
+	SensiboMaxRetries   int      `yaml:"sensibo_max_retries"`    // SENSIBO_MAX_RETRIES
+	SensiboRate         float64  `yaml:"sensibo_rate"`           // SENSIBO_RATE
+	SensiboFields       []string `yaml:"sensibo_fields"`         // SENSIBO_FIELDS
+	SensiboAPIKeyHeader string   `yaml:"sensibo_api_key_header"` // SENSIBO_API_KEY_HEADER
+	RoomMeasurements    []string `yaml:"room_measurements"`      // ROOM_MEASUREMENTS
+	SensiboStrict       bool     `yaml:"sensibo_strict"`         // SENSIBO_STRICT
+	DetailedPoll        bool     `yaml:"detailed_poll"`          // DETAILED_POLL
+	ExpectedDeviceCount int      `yaml:"expected_device_count"`  // EXPECTED_DEVICE_COUNT
+	IncludeRooms        []string `yaml:"include_rooms"`          // INCLUDE_ROOMS
+	ExcludeRooms        []string `yaml:"exclude_rooms"`          // EXCLUDE_ROOMS
+	IncludeDeviceIDs    []string `yaml:"include_device_ids"`     // INCLUDE_DEVICE_IDS
+	ExcludeDeviceIDs    []string `yaml:"exclude_device_ids"`     // EXCLUDE_DEVICE_IDS
+
+	WeatherLat            string            `yaml:"weather_lat"`             // WEATHER_LAT
+	WeatherLon            string            `yaml:"weather_lon"`             // WEATHER_LON
+	WeatherLocationName   string            `yaml:"weather_location_name"`   // WEATHER_LOCATION_NAME
+	WeatherCity           string            `yaml:"weather_city"`            // WEATHER_CITY
+	WeatherCoordPrecision int               `yaml:"weather_coord_precision"` // WEATHER_COORD_PRECISION
+	WeatherLocations      []weatherLocation `yaml:"weather_locations"`       // WEATHER_LOCATIONS
+	WeatherProvider       string            `yaml:"weather_provider"`        // WEATHER_PROVIDER
+	WeatherTimezone       string            `yaml:"weather_timezone"`        // WEATHER_TIMEZONE
+	WeatherMode           string            `yaml:"weather_mode"`            // WEATHER_MODE
+	WeatherMaxRetries     int               `yaml:"weather_max_retries"`     // WEATHER_MAX_RETRIES
+	WeatherRate           float64           `yaml:"weather_rate"`            // WEATHER_RATE
+	DisableOutsideTemp    bool              `yaml:"disable_outside_temp"`    // DISABLE_OUTSIDE_TEMP
+	EnableAirQuality      bool              `yaml:"enable_air_quality"`      // ENABLE_AIR_QUALITY
+	WeatherCacheFile      string            `yaml:"weather_cache_file"`      // WEATHER_CACHE_FILE
+	WeatherCacheTTL       time.Duration     `yaml:"weather_cache_ttl"`       // WEATHER_CACHE_TTL
+
+	Exporter                  string            `yaml:"exporter"`                    // EXPORTER
+	Sinks                     []string          `yaml:"sinks"`                       // SINKS
+	MetricPrefix              string            `yaml:"metric_prefix"`               // METRIC_PREFIX
+	GoogleProject             string            `yaml:"google_project"`              // GOOGLE_PROJECT
+	StackdriverFallback       string            `yaml:"stackdriver_fallback"`        // STACKDRIVER_FALLBACK
+	StackdriverResourceType   string            `yaml:"stackdriver_resource_type"`   // STACKDRIVER_RESOURCE_TYPE
+	StackdriverResourceLabels map[string]string `yaml:"stackdriver_resource_labels"` // STACKDRIVER_RESOURCE_LABELS
+	PrometheusPort            string            `yaml:"prometheus_port"`             // PROMETHEUS_PORT
+	PubSubTopic               string            `yaml:"pubsub_topic"`                // PUBSUB_TOPIC
+	PushgatewayURL            string            `yaml:"pushgateway_url"`             // PUSHGATEWAY_URL
+	PushgatewayInstance       string            `yaml:"pushgateway_instance"`        // PUSHGATEWAY_INSTANCE
+	TextfilePath              string            `yaml:"textfile_path"`               // TEXTFILE_PATH
+	OTLPEndpoint              string            `yaml:"otlp_endpoint"`               // OTLP_ENDPOINT
+	OTLPInsecure              bool              `yaml:"otlp_insecure"`               // OTLP_INSECURE
+	MQTTBroker                string            `yaml:"mqtt_broker"`                 // MQTT_BROKER
+	MQTTClientID              string            `yaml:"mqtt_client_id"`              // MQTT_CLIENT_ID
+	MQTTUsername              string            `yaml:"mqtt_username"`               // MQTT_USERNAME
+	MQTTPassword              string            `yaml:"mqtt_password"`               // MQTT_PASSWORD
+	InfluxURL                 string            `yaml:"influx_url"`                  // INFLUX_URL
+	InfluxBucket              string            `yaml:"influx_bucket"`               // INFLUX_BUCKET
+	InfluxOrg                 string            `yaml:"influx_org"`                  // INFLUX_ORG
+	InfluxToken               string            `yaml:"influx_token"`                // INFLUX_TOKEN
+	CSVFile                   string            `yaml:"csv_file"`                    // CSV_FILE
+	SQLitePath                string            `yaml:"sqlite_path"`                 // SQLITE_PATH
+
+	ScrapeInterval        time.Duration `yaml:"scrape_interval"`         // SCRAPE_INTERVAL
+	CycleTimeout          time.Duration `yaml:"cycle_timeout"`           // CYCLE_TIMEOUT
+	ReportingPeriod       time.Duration `yaml:"reporting_period"`        // REPORTING_PERIOD
+	MeasurementAgeWarning time.Duration `yaml:"measurement_age_warning"` // MEASUREMENT_AGE_WARNING
+	MaxMeasurementAge     time.Duration `yaml:"max_measurement_age"`     // MAX_MEASUREMENT_AGE
+	DeviceGracePeriod     time.Duration `yaml:"device_grace_period"`     // DEVICE_GRACE_PERIOD
+	ACRuntimeStateFile    string        `yaml:"ac_runtime_state_file"`   // AC_RUNTIME_STATE_FILE
+	DailyStateFile        string        `yaml:"daily_state_file"`        // DAILY_STATE_FILE
+	BackfillHours         int           `yaml:"backfill_hours"`          // BACKFILL_HOURS
+	EMAAlpha              float64       `yaml:"ema_alpha"`               // EMA_ALPHA
+	HTTPTimeout           time.Duration `yaml:"http_timeout"`            // HTTP_TIMEOUT
+	ProxyURL              string        `yaml:"proxy_url"`               // PROXY_URL
+	CACertFile            string        `yaml:"ca_cert_file"`            // CA_CERT_FILE
+	InsecureSkipVerify    bool          `yaml:"insecure_skip_verify"`    // INSECURE_SKIP_VERIFY
+	MaxConcurrency        int           `yaml:"max_concurrency"`         // MAX_CONCURRENCY
+	TempUnit              string        `yaml:"temp_unit"`               // TEMP_UNIT
+	DualUnits             bool          `yaml:"dual_units"`              // DUAL_UNITS
+	DryRun                bool          `yaml:"dry_run"`                 // DRY_RUN
+	HealthPort            string        `yaml:"health_port"`             // HEALTH_PORT
+	LogFormat             string        `yaml:"log_format"`              // LOG_FORMAT
+	LogLevel              string        `yaml:"log_level"`               // LOG_LEVEL
+
+	WebhookURL   string                     `yaml:"webhook_url"`    // WEBHOOK_URL
+	AlertMinTemp *float64                   `yaml:"alert_min_temp"` // ALERT_MIN_TEMP
+	AlertMaxTemp *float64                   `yaml:"alert_max_temp"` // ALERT_MAX_TEMP
+	AlertRooms   map[string]alertThresholds `yaml:"alert_rooms"`    // ALERT_ROOMS
+
+	SanitizeFallback string `yaml:"sanitize_fallback"` // SANITIZE_FALLBACK
+	SanitizeHash     bool   `yaml:"sanitize_hash"`     // SANITIZE_HASH
+}
+
+// defaultConfig returns the configuration used for unset fields.
+func defaultConfig() Config {
+	hostname, _ := os.Hostname()
+	return Config{
+		SensiboMaxRetries:     defaultMaxAttempts,
+		SensiboFields:         sensiboRequiredFields(),
+		WeatherLat:            defaultWeatherLat,
+		WeatherLon:            defaultWeatherLon,
+		WeatherCoordPrecision: 2,
+		WeatherProvider:       "open-meteo",
+		WeatherTimezone:       defaultWeatherTimezone,
+		WeatherMode:           "current",
+		WeatherMaxRetries:     defaultMaxAttempts,
+		WeatherCacheTTL:       time.Hour,
+		Exporter:              "stackdriver",
+		StackdriverFallback:   "error",
+		MetricPrefix:          "home_ac_",
+		PrometheusPort:        defaultPrometheusPort,
+		PushgatewayInstance:   hostname,
+		MQTTClientID:          "home-ac-stats",
+		HTTPTimeout:           defaultHTTPTimeout,
+		MaxConcurrency:        runtime.GOMAXPROCS(0),
+		MeasurementAgeWarning: defaultMeasurementAgeWarning,
+		DeviceGracePeriod:     time.Hour,
+		TempUnit:              string(celsius),
+		LogFormat:             "text",
+		LogLevel:              "info",
+		SanitizeFallback:      defaultSanitizeFallback,
+	}
+}
+
+// LoadConfig builds the configuration from, in increasing order of
+// precedence, the defaults, the YAML config file, environment variables and
+// the command-line flags in args, and validates the result. It returns
+// flag.ErrHelp for -help and errVersion for -version.
+func LoadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+	f, err := parseFlags(args, cfg)
+	if err != nil {
+		return Config{}, err
+	}
+	if f.configFile != "" {
+		b, err := os.ReadFile(f.configFile)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read config file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil {
+			return Config{}, fmt.Errorf("failed to parse config file %s: %w", f.configFile, err)
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.applyFlags(f); err != nil {
+		return Config{}, err
+	}
+	cfg.setWeatherLocations()
+	return cfg, cfg.Validate()
+}
+
+// cliFlags are the parsed command-line flags.
+type cliFlags struct {
+	configFile string
+	once       bool
+	interval   time.Duration
+	dryRun     bool
+	exporter   string
+	set        map[string]bool // names of the flags given
+}
+
+// errVersion is returned by LoadConfig when the version is requested with
+// -version.
+var errVersion = errors.New("version requested")
+
+// parseFlags parses args, showing the values in def as defaults. Invalid flags
+// are reported with the usage, as is -help (flag.ErrHelp).
+func parseFlags(args []string, def Config) (cliFlags, error) {
+	var f cliFlags
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	showVersion := fs.Bool("version", false, "print the version and exit")
+	fs.StringVar(&f.configFile, "config", os.Getenv("CONFIG_FILE"), "path to a YAML config file (env CONFIG_FILE)")
+	fs.BoolVar(&f.once, "once", false, "collect once and exit, ignoring SCRAPE_INTERVAL")
+	fs.DurationVar(&f.interval, "interval", def.ScrapeInterval, "collect on this interval until interrupted, 0 to collect once (env SCRAPE_INTERVAL)")
+	fs.BoolVar(&f.dryRun, "dry-run", def.DryRun, "log the metrics instead of exporting them (env DRY_RUN)")
+	fs.StringVar(&f.exporter, "exporter", def.Exporter, "metrics exporter: "+strings.Join(exporterNames, ", ")+" (env EXPORTER)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags]\n\n", fs.Name())
+		fmt.Fprintf(fs.Output(), "Flags override environment variables, which override the config file.\n")
+		fmt.Fprintf(fs.Output(), "See README.md for all environment variables.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return cliFlags{}, err
+		}
+		return cliFlags{}, fmt.Errorf("invalid flags: %w", err)
+	}
+	if *showVersion {
+		return cliFlags{}, errVersion
+	}
+	f.set = make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) { f.set[fl.Name] = true })
+	return f, nil
+}
+
+// applyFlags overrides c with the flags that were given.
+func (c *Config) applyFlags(f cliFlags) error {
+	if f.once && f.set["interval"] {
+		return errors.New("flags -once and -interval are mutually exclusive")
+	}
+	if f.set["interval"] {
+		c.ScrapeInterval = f.interval
+	}
+	if f.once {
+		c.ScrapeInterval = 0
+	}
+	if f.set["dry-run"] {
+		c.DryRun = f.dryRun
+	}
+	if f.set["exporter"] {
+		// The flag has precedence over SINKS from the environment or file.
+		c.Exporter, c.Sinks = f.exporter, nil
+	}
+	return nil
+}
+
+// sinkNames returns the exporters to fan the readings out to: SINKS, or
+// EXPORTER if it is not set.
+func (c *Config) sinkNames() []string {
+	if len(c.Sinks) > 0 {
+		return c.Sinks
+	}
+	return []string{c.Exporter}
+}
+
+// hasSink reports whether the readings go to the exporter called name.
+func (c *Config) hasSink(name string) bool {
+	return slices.Contains(c.sinkNames(), name)
+}
+
+func (c *Config) applyEnv() error {
+	envList("SENSIBO_API_KEY", &c.SensiboAPIKeys)
+	envList("SENSIBO_ACCOUNT_NAMES", &c.SensiboAccountNames)
+	envList("SENSIBO_FIELDS", &c.SensiboFields)
+	envString("SENSIBO_API_KEY_HEADER", &c.SensiboAPIKeyHeader)
+	envList("ROOM_MEASUREMENTS", &c.RoomMeasurements)
+	envList("INCLUDE_ROOMS", &c.IncludeRooms)
+	envList("EXCLUDE_ROOMS", &c.ExcludeRooms)
+	envList("INCLUDE_DEVICE_IDS", &c.IncludeDeviceIDs)
+	envList("EXCLUDE_DEVICE_IDS", &c.ExcludeDeviceIDs)
+	envString("WEATHER_LAT", &c.WeatherLat)
+	envString("WEATHER_LON", &c.WeatherLon)
+	envString("WEATHER_LOCATION_NAME", &c.WeatherLocationName)
+	envString("WEATHER_CITY", &c.WeatherCity)
+	envString("WEATHER_PROVIDER", &c.WeatherProvider)
+	envString("WEATHER_TIMEZONE", &c.WeatherTimezone)
+	envString("WEATHER_MODE", &c.WeatherMode)
+	if s, ok := os.LookupEnv("METRIC_PREFIX"); ok { // may be set empty
+		c.MetricPrefix = s
+	}
+	envString("WEATHER_CACHE_FILE", &c.WeatherCacheFile)
+	envString("EXPORTER", &c.Exporter)
+	envList("SINKS", &c.Sinks)
+	envString("GOOGLE_PROJECT", &c.GoogleProject)
+	envString("STACKDRIVER_FALLBACK", &c.StackdriverFallback)
+	envString("STACKDRIVER_RESOURCE_TYPE", &c.StackdriverResourceType)
+	envString("PROMETHEUS_PORT", &c.PrometheusPort)
+	envString("PUBSUB_TOPIC", &c.PubSubTopic)
+	envString("PUSHGATEWAY_URL", &c.PushgatewayURL)
+	envString("PUSHGATEWAY_INSTANCE", &c.PushgatewayInstance)
+	envString("TEXTFILE_PATH", &c.TextfilePath)
+	envString("OTLP_ENDPOINT", &c.OTLPEndpoint)
+	envString("MQTT_BROKER", &c.MQTTBroker)
+	envString("MQTT_CLIENT_ID", &c.MQTTClientID)
+	envString("MQTT_USERNAME", &c.MQTTUsername)
+	envString("MQTT_PASSWORD", &c.MQTTPassword)
+	envString("INFLUX_URL", &c.InfluxURL)
+	envString("INFLUX_BUCKET", &c.InfluxBucket)
+	envString("INFLUX_ORG", &c.InfluxOrg)
+	envString("INFLUX_TOKEN", &c.InfluxToken)
+	envString("CSV_FILE", &c.CSVFile)
+	envString("SQLITE_PATH", &c.SQLitePath)
+	envString("AC_RUNTIME_STATE_FILE", &c.ACRuntimeStateFile)
+	envString("DAILY_STATE_FILE", &c.DailyStateFile)
+	envString("PROXY_URL", &c.ProxyURL)
+	envString("CA_CERT_FILE", &c.CACertFile)
+	envString("TEMP_UNIT", &c.TempUnit)
+	envString("HEALTH_PORT", &c.HealthPort)
+	envString("LOG_FORMAT", &c.LogFormat)
+	envString("LOG_LEVEL", &c.LogLevel)
+	envString("SANITIZE_FALLBACK", &c.SanitizeFallback)
+	envString("WEBHOOK_URL", &c.WebhookURL)
+	var locErr, alertErr, labelsErr error
+	if v := os.Getenv("WEATHER_LOCATIONS"); v != "" {
+		if c.WeatherLocations, locErr = parseWeatherLocations(v); locErr != nil {
+			locErr = fmt.Errorf("invalid WEATHER_LOCATIONS: %w", locErr)
+		}
+	}
+	if v := os.Getenv("ALERT_ROOMS"); v != "" {
+		if c.AlertRooms, alertErr = parseAlertRooms(v); alertErr != nil {
+			alertErr = fmt.Errorf("invalid ALERT_ROOMS: %w", alertErr)
+		}
+	}
+	if v := os.Getenv("STACKDRIVER_RESOURCE_LABELS"); v != "" {
+		if c.StackdriverResourceLabels, labelsErr = parseLabels(v); labelsErr != nil {
+			labelsErr = fmt.Errorf("invalid STACKDRIVER_RESOURCE_LABELS: %w", labelsErr)
+		}
+	}
+	return errors.Join(
+		locErr,
+		alertErr,
+		labelsErr,
+		envInt("SENSIBO_MAX_RETRIES", &c.SensiboMaxRetries),
+		envInt("MAX_CONCURRENCY", &c.MaxConcurrency),
+		envInt("WEATHER_MAX_RETRIES", &c.WeatherMaxRetries),
+		envInt("EXPECTED_DEVICE_COUNT", &c.ExpectedDeviceCount),
+		envInt("BACKFILL_HOURS", &c.BackfillHours),
+		envInt("WEATHER_COORD_PRECISION", &c.WeatherCoordPrecision),
+		envFloat("SENSIBO_RATE", &c.SensiboRate),
+		envFloat("WEATHER_RATE", &c.WeatherRate),
+		envFloat("EMA_ALPHA", &c.EMAAlpha),
+		envFloatPtr("ALERT_MIN_TEMP", &c.AlertMinTemp),
+		envFloatPtr("ALERT_MAX_TEMP", &c.AlertMaxTemp),
+		envDuration("WEATHER_CACHE_TTL", &c.WeatherCacheTTL),
+		envDuration("SCRAPE_INTERVAL", &c.ScrapeInterval),
+		envDuration("CYCLE_TIMEOUT", &c.CycleTimeout),
+		envDuration("REPORTING_PERIOD", &c.ReportingPeriod),
+		envDuration("HTTP_TIMEOUT", &c.HTTPTimeout),
+		envDuration("MEASUREMENT_AGE_WARNING", &c.MeasurementAgeWarning),
+		envDuration("MAX_MEASUREMENT_AGE", &c.MaxMeasurementAge),
+		envDuration("DEVICE_GRACE_PERIOD", &c.DeviceGracePeriod),
+		envBool("SENSIBO_STRICT", &c.SensiboStrict),
+		envBool("DETAILED_POLL", &c.DetailedPoll),
+		envBool("DRY_RUN", &c.DryRun),
+		envBool("DUAL_UNITS", &c.DualUnits),
+		envBool("INSECURE_SKIP_VERIFY", &c.InsecureSkipVerify),
+		envBool("SANITIZE_HASH", &c.SanitizeHash),
+		envBool("ENABLE_AIR_QUALITY", &c.EnableAirQuality),
+		envBool("DISABLE_OUTSIDE_TEMP", &c.DisableOutsideTemp),
+		envBool("OTLP_INSECURE", &c.OTLPInsecure),
+	)
+}
+
+// Validate checks the configuration, reporting all problems at once.
+func (c Config) Validate() error {
+	var errs []error
+	if len(c.SensiboAPIKeys) == 0 {
+		errs = append(errs, errors.New("missing required sensibo_api_keys (SENSIBO_API_KEY)"))
+	}
+	for i, k := range c.SensiboAPIKeys {
+		if strings.TrimSpace(k) == "" {
+			errs = append(errs, fmt.Errorf("empty sensibo API key at position %d", i))
+		}
+	}
+	if len(c.SensiboAccountNames) > len(c.SensiboAPIKeys) {
+		errs = append(errs, fmt.Errorf("got %d sensibo account names for %d API keys",
+			len(c.SensiboAccountNames), len(c.SensiboAPIKeys)))
+	}
+	seen := make(map[string]bool)
+	for i, l := range c.WeatherLocations {
+		if strings.TrimSpace(l.Name) == "" {
+			errs = append(errs, fmt.Errorf("weather location at position %d has no name", i))
+			continue
+		}
+		if err := validateCoordinates(l.Lat, l.Lon); err != nil {
+			errs = append(errs, fmt.Errorf("weather location %s: %w", l.Name, err))
+		}
+		if seen[l.Name] {
+			errs = append(errs, fmt.Errorf("duplicate weather location %s", l.Name))
+		}
+		seen[l.Name] = true
+	}
+	if _, ok := weatherProviders[c.WeatherProvider]; !ok {
+		errs = append(errs, fmt.Errorf("invalid weather_provider %q (supported: open-meteo, met-no)", c.WeatherProvider))
+	}
+	if err := validateSensiboFields(trimList(c.SensiboFields)); err != nil {
+		errs = append(errs, err)
+	}
+	if h := c.SensiboAPIKeyHeader; h != "" && !validHeaderName.MatchString(h) {
+		errs = append(errs, fmt.Errorf("invalid sensibo_api_key_header %q: must be an HTTP header name", h))
+	}
+	if strings.TrimSpace(c.WeatherTimezone) == "" {
+		errs = append(errs, errors.New("invalid weather_timezone: must be a timezone name or auto"))
+	}
+	if _, err := parseWeatherMode(c.WeatherMode); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseTempUnit(c.TempUnit); err != nil {
+		errs = append(errs, err)
+	}
+	for i, name := range c.sinkNames() {
+		if !slices.Contains(exporterNames, name) {
+			errs = append(errs, fmt.Errorf("invalid exporter %q (supported: %s)", name, strings.Join(exporterNames, ", ")))
+		} else if slices.Index(c.sinkNames(), name) < i {
+			errs = append(errs, fmt.Errorf("invalid sinks: %q is listed more than once", name))
+		}
+	}
+	if c.hasSink("pubsub") {
+		if c.GoogleProject == "" {
+			errs = append(errs, errors.New("missing required google_project (GOOGLE_PROJECT) for the pubsub exporter"))
+		}
+		if c.PubSubTopic == "" {
+			errs = append(errs, errors.New("missing required pubsub_topic (PUBSUB_TOPIC) for the pubsub exporter"))
+		}
+	}
+	if !slices.Contains(stackdriverFallbacks, c.StackdriverFallback) {
+		errs = append(errs, fmt.Errorf("invalid stackdriver_fallback %q (supported: %s)", c.StackdriverFallback, strings.Join(stackdriverFallbacks, ", ")))
+	}
+	if c.StackdriverResourceType != "" {
+		if err := validateMonitoredResource(c.StackdriverResourceType, c.StackdriverResourceLabels); err != nil {
+			errs = append(errs, err)
+		}
+	} else if len(c.StackdriverResourceLabels) > 0 {
+		errs = append(errs, errors.New("stackdriver_resource_labels require stackdriver_resource_type (STACKDRIVER_RESOURCE_TYPE)"))
+	}
+	if c.hasSink("textfile") && c.TextfilePath == "" {
+		errs = append(errs, errors.New("missing required textfile_path (TEXTFILE_PATH) for the textfile exporter"))
+	}
+	if c.hasSink("pushgateway") && c.PushgatewayURL == "" {
+		errs = append(errs, errors.New("missing required pushgateway_url (PUSHGATEWAY_URL) for the pushgateway exporter"))
+	}
+	if c.hasSink("otlp") && c.OTLPEndpoint == "" {
+		errs = append(errs, errors.New("missing required otlp_endpoint (OTLP_ENDPOINT) for the otlp exporter"))
+	}
+	if c.hasSink("mqtt") && c.MQTTBroker == "" {
+		errs = append(errs, errors.New("missing required mqtt_broker (MQTT_BROKER) for the mqtt exporter"))
+	}
+	if c.hasSink("influx") {
+		if c.InfluxURL == "" {
+			errs = append(errs, errors.New("missing required influx_url (INFLUX_URL) for the influx exporter"))
+		}
+		if c.InfluxBucket == "" {
+			errs = append(errs, errors.New("missing required influx_bucket (INFLUX_BUCKET) for the influx exporter"))
+		}
+	}
+	if c.MaxConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("invalid max_concurrency %d: must be a positive integer", c.MaxConcurrency))
+	}
+	for name, v := range map[string]int{
+		"sensibo_max_retries": c.SensiboMaxRetries,
+		"weather_max_retries": c.WeatherMaxRetries,
+	} {
+		if v < 1 || v > maxRetryAttempts {
+			errs = append(errs, fmt.Errorf("invalid %s %d: must be between 1 and %d", name, v, maxRetryAttempts))
+		}
+	}
+	for name, v := range map[string]time.Duration{
+		"weather_cache_ttl":       c.WeatherCacheTTL,
+		"http_timeout":            c.HTTPTimeout,
+		"measurement_age_warning": c.MeasurementAgeWarning,
+		"device_grace_period":     c.DeviceGracePeriod,
+	} {
+		if v <= 0 {
+			errs = append(errs, fmt.Errorf("invalid %s %v: must be a positive duration", name, v))
+		}
+	}
+	if !validMetricPrefix.MatchString(c.MetricPrefix) {
+		errs = append(errs, fmt.Errorf("invalid metric_prefix %q: must only contain ASCII letters, digits and underscores, and not start with a digit", c.MetricPrefix))
+	}
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(c.WebhookURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, errors.New("invalid webhook_url: must be a URL like https://hooks.slack.com/services/..."))
+		}
+	} else if c.AlertMinTemp != nil || c.AlertMaxTemp != nil || len(c.AlertRooms) > 0 {
+		errs = append(errs, errors.New("alert thresholds require webhook_url (WEBHOOK_URL)"))
+	}
+	if err := (alertThresholds{Min: c.AlertMinTemp, Max: c.AlertMaxTemp}).validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid alert thresholds: %w", err))
+	}
+	for room, t := range c.AlertRooms {
+		if err := t.or(alertThresholds{Min: c.AlertMinTemp, Max: c.AlertMaxTemp}).validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid alert thresholds of room %q: %w", room, err))
+		}
+	}
+	if c.ProxyURL != "" {
+		if u, err := url.Parse(c.ProxyURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid proxy_url %q: must be a URL like http://proxy:3128", c.ProxyURL))
+		}
+	}
+	if c.ReportingPeriod != 0 && c.ReportingPeriod < time.Second {
+		errs = append(errs, fmt.Errorf("invalid reporting_period %v: must be at least 1s", c.ReportingPeriod))
+	}
+	for name, v := range map[string]float64{
+		"sensibo_rate": c.SensiboRate,
+		"weather_rate": c.WeatherRate,
+	} {
+		if v < 0 {
+			errs = append(errs, fmt.Errorf("invalid %s %g: must not be negative", name, v))
+		}
+	}
+	if c.EMAAlpha < 0 || c.EMAAlpha > 1 {
+		errs = append(errs, fmt.Errorf("invalid ema_alpha %g: must be between 0 and 1", c.EMAAlpha))
+	}
+	if c.BackfillHours < 0 || c.BackfillHours > maxBackfillHours {
+		errs = append(errs, fmt.Errorf("invalid backfill_hours %d: must be between 0 and %d", c.BackfillHours, maxBackfillHours))
+	}
+	if c.WeatherCoordPrecision < 0 || c.WeatherCoordPrecision > 6 {
+		errs = append(errs, fmt.Errorf("invalid weather_coord_precision %d: must be between 0 and 6", c.WeatherCoordPrecision))
+	}
+	if c.ExpectedDeviceCount < 0 {
+		errs = append(errs, fmt.Errorf("invalid expected_device_count %d: must not be negative", c.ExpectedDeviceCount))
+	}
+	if c.SanitizeFallback == "" || sanitizeString(c.SanitizeFallback) != c.SanitizeFallback {
+		errs = append(errs, fmt.Errorf("invalid sanitize_fallback %q: must be a non-empty tag value of ASCII letters, digits and underscores", c.SanitizeFallback))
+	}
+	if c.ScrapeInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid scrape_interval %v: must not be negative", c.ScrapeInterval))
+	}
+	if c.MaxMeasurementAge < 0 {
+		errs = append(errs, fmt.Errorf("invalid max_measurement_age %v: must not be negative", c.MaxMeasurementAge))
+	}
+	if c.CycleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid cycle_timeout %v: must not be negative", c.CycleTimeout))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// setWeatherLocations fills in WeatherLocations from the single location
+// settings unless a list of locations is configured. Names are sanitized by
+// run, once the sanitization settings are in effect, and WeatherCity is
+// resolved by run too.
+func (c *Config) setWeatherLocations() {
+	if len(c.WeatherLocations) > 0 {
+		return
+	}
+	name := coordinatesName(c.WeatherLat, c.WeatherLon)
+	if c.WeatherCity != "" {
+		name = c.WeatherCity
+	}
+	if c.WeatherLocationName != "" {
+		name = c.WeatherLocationName
+	}
+	c.WeatherLocations = []weatherLocation{{Name: name, Lat: c.WeatherLat, Lon: c.WeatherLon, city: c.WeatherCity}}
+}
+
+// envString sets *v to the environment variable name, if set.
+func envString(name string, v *string) {
+	if s := os.Getenv(name); s != "" {
+		*v = s
+	}
+}
+
+// envList sets *v to the comma-separated environment variable name, if set.
+func envList(name string, v *[]string) {
+	if s := os.Getenv(name); s != "" {
+		*v = strings.Split(s, ",")
+	}
+}
+
+// envBool sets *v to the boolean environment variable name, if set.
+func envBool(name string, v *bool) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("invalid %s=%q: must be a boolean", name, s)
+	}
+	*v = b
+	return nil
+}
+
+// envInt sets *v to the integer environment variable name, if set.
+func envInt(name string, v *int) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid %s=%q: must be an integer", name, s)
+	}
+	*v = n
+	return nil
+}
+
+// envFloat sets *v to the number environment variable name, if set.
+func envFloat(name string, v *float64) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s=%q: must be a number", name, s)
+	}
+	*v = f
+	return nil
+}
+
+// envFloatPtr sets *v to the numeric environment variable name, if set.
+func envFloatPtr(name string, v **float64) error {
+	var f float64
+	if os.Getenv(name) == "" {
+		return nil
+	}
+	if err := envFloat(name, &f); err != nil {
+		return err
+	}
+	*v = &f
+	return nil
+}
+
+// envDuration sets *v to the duration environment variable name, if set.
+func envDuration(name string, v *time.Duration) error {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid %s=%q: must be a duration like 60s", name, s)
+	}
+	*v = d
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigFlagErrors(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want error // nil for any error other than the sentinels
+	}{
+		{[]string{"-version"}, errVersion},
+		{[]string{"-help"}, flag.ErrHelp},
+		{[]string{"-no-such-flag"}, nil},
+		{[]string{"-interval", "soon"}, nil},
+	} {
+		_, err := LoadConfig(tt.args)
+		switch {
+		case err == nil:
+			t.Errorf("LoadConfig(%q) succeeded, want an error", tt.args)
+		case tt.want != nil && !errors.Is(err, tt.want):
+			t.Errorf("LoadConfig(%q) = %v, want %v", tt.args, err, tt.want)
+		case tt.want == nil && (errors.Is(err, errVersion) || errors.Is(err, flag.ErrHelp)):
+			t.Errorf("LoadConfig(%q) = %v, want an invalid flag error", tt.args, err)
+		}
+	}
+}
+
+func TestRunVersion(t *testing.T) {
+	if err := run(context.Background(), []string{"-version"}); !errors.Is(err, errVersion) {
+		t.Errorf("run(-version) = %v, want errVersion", err)
+	}
+}
+
+func TestLoadConfigExporterFlagOverridesSinks(t *testing.T) {
+	t.Setenv("SENSIBO_API_KEY", "k")
+	t.Setenv("SINKS", "jsonlines")
+
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.sinkNames(); !reflect.DeepEqual(got, []string{"jsonlines"}) {
+		t.Errorf("sinks = %v, want [jsonlines] from SINKS", got)
+	}
+	cfg, err = LoadConfig([]string{"-exporter", "prometheus"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.sinkNames(); !reflect.DeepEqual(got, []string{"prometheus"}) {
+		t.Errorf("sinks = %v, want [prometheus] from -exporter", got)
+	}
+}
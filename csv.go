@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// csvOut appends readings to the CSV_FILE, or is nil if it is not enabled.
+// Backfill writes to it too.
+var csvOut *csvWriter
+
+// csvHeader is the schema of the CSV file. Columns must not be renamed,
+// removed or reordered.
+var csvHeader = []string{"timestamp", "location_outside_temp", "room", "device_id", "room_temp", "ac_on"}
+
+// csvWriter appends one row per device and collection cycle to a file. It is
+// safe for concurrent use.
+type csvWriter struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *csv.Writer
+}
+
+// openCSV opens path for appending, writing the header if the file is new or
+// empty.
+func openCSV(path string) (*csvWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open csv file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open csv file: %w", err)
+	}
+	c := &csvWriter{f: f, w: csv.NewWriter(f)}
+	if fi.Size() == 0 {
+		if err := c.flush([][]string{csvHeader}); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// write appends the readings of a collection cycle. The outside temperature
+// column is empty if it is unavailable. Offline devices are left out, as they
+// report their last known readings, and so are stale readings.
+func (c *csvWriter) write(r CollectionResult) error {
+	var outside string
+	if r.OutsideTemp != nil {
+		outside = formatFloat(*r.OutsideTemp)
+	}
+	ts := r.Time.UTC().Format(time.RFC3339)
+	rows := make([][]string, 0, len(r.Devices))
+	for _, d := range r.Devices {
+		if !d.Online || d.Stale {
+			continue
+		}
+		rows = append(rows, []string{
+			ts,
+			outside,
+			d.Room,
+			d.DeviceID,
+			formatFloat(d.Temp),
+			strconv.FormatBool(d.ACOn),
+		})
+	}
+	return c.writeRows(rows)
+}
+
+// Record appends the readings of r.
+func (c *csvWriter) Record(_ context.Context, r CollectionResult) error {
+	if err := c.write(r); err != nil {
+		return fmt.Errorf("failed to write readings to csv: %w", err)
+	}
+	return nil
+}
+
+// writeRows appends rows in the csvHeader schema.
+func (c *csvWriter) writeRows(rows [][]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush(rows)
+}
+
+func (c *csvWriter) flush(rows [][]string) error {
+	if err := c.w.WriteAll(rows); err != nil { // WriteAll flushes
+		return fmt.Errorf("failed to write csv file: %w", err)
+	}
+	return nil
+}
+
+func (c *csvWriter) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.f.Close()
+}
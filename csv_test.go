@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCSVWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readings.csv")
+	c, err := openCSV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	outside := 11.5
+	r := CollectionResult{Time: time.Unix(1700000000, 0), OutsideTemp: &outside, Devices: fixtureReadings()}
+	if err := c.write(r); err != nil {
+		t.Fatal(err)
+	}
+	r.OutsideTemp = nil
+	if err := c.write(r); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The offline garage is left out.
+	want := `timestamp,location_outside_temp,room,device_id,room_temp,ac_on
+2023-11-14T22:13:20Z,11.5,Living_Room,liv1,24.5,true
+2023-11-14T22:13:20Z,11.5,Kids_Bedroom,bed1,20.25,false
+2023-11-14T22:13:20Z,,Living_Room,liv1,24.5,true
+2023-11-14T22:13:20Z,,Kids_Bedroom,bed1,20.25,false
+`
+	if string(b) != want {
+		t.Errorf("csv file =\n%s\nwant\n%s", b, want)
+	}
+}
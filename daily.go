@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// roomTempDaily tracks the daily range of the room temperatures, or is nil
+// outside of daemon mode.
+var roomTempDaily *dailyTracker
+
+// dailyTracker tracks the minimum and maximum room temperature of each device
+// since midnight in loc.
+type dailyTracker struct {
+	loc  *time.Location
+	unit tempUnit
+
+	mu      sync.Mutex
+	devices map[string]*dailyRange // by device ID
+}
+
+type dailyRange struct {
+	Day  string   `json:"day"` // date in loc, as 2006-01-02
+	Unit tempUnit `json:"unit"`
+	Min  float64  `json:"min"`
+	Max  float64  `json:"max"`
+}
+
+func newDailyTracker(loc *time.Location, unit tempUnit) *dailyTracker {
+	return &dailyTracker{loc: loc, unit: unit, devices: make(map[string]*dailyRange)}
+}
+
+// update adds the temperature of device id at now, and returns its range for
+// the day. The range restarts on the first update of a day, using the
+// calendar date in loc rather than 24-hour periods so that days are right
+// across DST changes.
+func (t *dailyTracker) update(id string, temp float64, now time.Time) (lo, hi float64) {
+	day := now.In(t.loc).Format(time.DateOnly)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.devices[id]
+	if !ok || r.Day != day || r.Unit != t.unit {
+		r = &dailyRange{Day: day, Unit: t.unit, Min: temp, Max: temp}
+		t.devices[id] = r
+	}
+	r.Min, r.Max = min(r.Min, temp), max(r.Max, temp)
+	return r.Min, r.Max
+}
+
+// load restores the ranges from path. A missing file is not an error; ranges
+// of a past day or of another TEMP_UNIT are restarted by update.
+func (t *dailyTracker) load(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read daily state: %w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := json.Unmarshal(b, &t.devices); err != nil {
+		return fmt.Errorf("failed to decode daily state: %w", err)
+	}
+	if t.devices == nil {
+		t.devices = make(map[string]*dailyRange)
+	}
+	return nil
+}
+
+// save writes the ranges to path.
+func (t *dailyTracker) save(path string) error {
+	t.mu.Lock()
+	b, err := json.Marshal(t.devices)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, b); err != nil {
+		return fmt.Errorf("failed to write daily state: %w", err)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ set -euo pipefail
 
 # build image with ko
 export KO_DOCKER_REPO=gcr.io/ahmet-personal-api
+export GOFLAGS="-ldflags=-X=main.version=$(git describe --always --dirty)"
 
 img="$(ko build .)"
 
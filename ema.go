@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// roomTempEMA smooths the room temperature of each device, or is nil if
+// smoothing is disabled (EMA_ALPHA unset, or outside of daemon mode).
+var roomTempEMA *emaTracker
+
+// emaTracker maintains an exponential moving average per device.
+type emaTracker struct {
+	alpha  float64       // weight of the latest reading, in (0, 1]
+	maxGap time.Duration // the average restarts after longer gaps
+
+	mu      sync.Mutex
+	devices map[string]*deviceEMA // by device ID
+}
+
+type deviceEMA struct {
+	value    float64
+	lastSeen time.Time
+}
+
+func newEMATracker(alpha float64, maxGap time.Duration) *emaTracker {
+	return &emaTracker{alpha: alpha, maxGap: maxGap, devices: make(map[string]*deviceEMA)}
+}
+
+// update adds the reading v of device id at now and returns the new average.
+// The average is seeded with the first reading of a device, and again when the
+// device reappears after missing collections for longer than maxGap, so that
+// outdated readings don't linger.
+func (t *emaTracker) update(id string, v float64, now time.Time) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.devices[id]
+	if !ok || now.Sub(d.lastSeen) > t.maxGap {
+		d = &deviceEMA{value: v}
+		t.devices[id] = d
+	} else {
+		d.value += t.alpha * (v - d.value)
+	}
+	d.lastSeen = now
+	return d.value
+}
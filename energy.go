@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// acEnergy accumulates the estimated energy used by each AC, or is nil if
+// energy tracking is disabled (outside of daemon mode).
+var acEnergy *energyTracker
+
+// energyTracker estimates the energy used by devices that report their
+// instantaneous power: the power reported at a collection is assumed to have
+// been drawn until the next one.
+type energyTracker struct {
+	maxGap time.Duration // longer gaps between collections are not counted
+
+	mu      sync.Mutex
+	devices map[string]powerSample // by device ID
+}
+
+type powerSample struct {
+	watts float64
+	time  time.Time
+}
+
+func newEnergyTracker(maxGap time.Duration) *energyTracker {
+	return &energyTracker{maxGap: maxGap, devices: make(map[string]powerSample)}
+}
+
+// update records that device id draws watts at now, and returns the
+// watt-hours to add to its cumulative energy counter.
+func (t *energyTracker) update(id string, watts float64, now time.Time) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev, ok := t.devices[id]
+	t.devices[id] = powerSample{watts: watts, time: now}
+	if gap := now.Sub(prev.time); ok && gap > 0 && gap <= t.maxGap {
+		return prev.watts * gap.Hours()
+	}
+	return 0
+}
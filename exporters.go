@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"contrib.go.opencensus.io/exporter/prometheus"
+	"contrib.go.opencensus.io/exporter/stackdriver"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"golang.org/x/oauth2/google"
+)
+
+const defaultPrometheusPort = "9090"
+
+// exporterNames lists the supported values of Config.Exporter.
+var exporterNames = []string{"stackdriver", "prometheus", "jsonlines", "influx", "pubsub", "mqtt", "otlp", "pushgateway", "textfile"}
+
+// startSink starts the exporter or sink called name, configured in cfg, and
+// returns a function that flushes and stops it.
+func startSink(name string, cfg Config) (s Sink, stop func(), err error) {
+	switch name {
+	case "stackdriver":
+		stop, err = startStackdriverExporter(cfg)
+		return nil, stop, err
+	case "prometheus":
+		stop, err = startPrometheusExporter(cfg.PrometheusPort)
+		return nil, stop, err
+	case "otlp":
+		stop, err = startOTLPExporter(cfg.OTLPEndpoint, cfg.OTLPInsecure, cfg.ScrapeInterval)
+		return nil, stop, err
+	case "jsonlines":
+		return sinkFunc(func(_ context.Context, r CollectionResult) error {
+			if err := writeJSONLines(stdout, r); err != nil {
+				return fmt.Errorf("failed to write json lines: %w", err)
+			}
+			return nil
+		}), func() {}, nil
+	case "pubsub":
+		return startPubSubExporter(cfg.GoogleProject, cfg.PubSubTopic)
+	case "pushgateway":
+		return startPushgatewayExporter(cfg.PushgatewayURL, cfg.PushgatewayInstance)
+	case "textfile":
+		return startTextfileExporter(cfg.TextfilePath)
+	case "mqtt":
+		return startMQTTExporter(cfg)
+	case "influx":
+		influx = newInfluxWriter(cfg.InfluxURL, cfg.InfluxBucket, cfg.InfluxOrg, cfg.InfluxToken)
+		return influx, func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown exporter %q (supported: %s)", name, strings.Join(exporterNames, ", "))
+	}
+}
+
+// stackdriverFallbacks are the supported values of Config.StackdriverFallback.
+var stackdriverFallbacks = []string{"error", "jsonlines"}
+
+// resolveGoogleProject detects the project of the stackdriver exporter, when
+// GoogleProject is not set, from the metadata server on Google Cloud or from
+// the application default credentials. If that fails, it replaces the
+// stackdriver exporter with jsonlines if StackdriverFallback says so, and
+// fails otherwise.
+func (c *Config) resolveGoogleProject(ctx context.Context) error {
+	if metadata.OnGCE() {
+		id, err := metadata.ProjectID()
+		if err == nil && id != "" {
+			slog.Info("using the project of the metadata server for the stackdriver exporter", "project", id)
+			c.GoogleProject = id
+			return nil
+		}
+		slog.Warn("failed to get the project from the metadata server", "err", err)
+	}
+	if creds, err := google.FindDefaultCredentials(ctx); err == nil && creds.ProjectID != "" {
+		slog.Info("using the project of the default credentials for the stackdriver exporter", "project", creds.ProjectID)
+		c.GoogleProject = creds.ProjectID
+		return nil
+	}
+	if c.StackdriverFallback != "jsonlines" {
+		return errors.New("missing google_project (GOOGLE_PROJECT) for the stackdriver exporter, and it could not be " +
+			"detected from the metadata server or the default credentials: set GOOGLE_PROJECT, choose another EXPORTER, " +
+			"or set STACKDRIVER_FALLBACK=jsonlines")
+	}
+	slog.Warn("missing google_project (GOOGLE_PROJECT) for the stackdriver exporter, falling back to the jsonlines exporter")
+	sinks := slices.DeleteFunc(slices.Clone(c.sinkNames()), func(s string) bool { return s == "stackdriver" })
+	if !slices.Contains(sinks, "jsonlines") {
+		sinks = append(sinks, "jsonlines")
+	}
+	c.Sinks = sinks
+	return nil
+}
+
+func startStackdriverExporter(cfg Config) (func(), error) {
+	opts := stackdriver.Options{
+		ProjectID:               cfg.GoogleProject,
+		ReportingInterval:       cfg.ReportingPeriod,   // default if zero
+		DefaultMonitoringLabels: &stackdriver.Labels{}, // remove default labels
+		OnError: func(err error) {
+			slog.Error("stackdriver exporter error", "err", err)
+		},
+	}
+	if cfg.StackdriverResourceType != "" {
+		opts.MonitoredResource = monitoredResource{typ: cfg.StackdriverResourceType, labels: cfg.StackdriverResourceLabels}
+	}
+	exporter, err := stackdriver.NewExporter(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := exporter.StartMetricsExporter(); err != nil {
+		return nil, fmt.Errorf("error starting metric exporter: %w", err)
+	}
+	return func() {
+		exporter.StopMetricsExporter()
+		exporter.Flush()
+	}, nil
+}
+
+func startPrometheusExporter(port string) (func(), error) {
+	exporter, err := prometheus.NewExporter(prometheus.Options{
+		OnError: func(err error) {
+			slog.Error("prometheus exporter error", "err", err)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	return startHTTPServer("prometheus metrics", ":"+port, mux), nil
+}
+
+// startPushgatewayExporter prepares pushing to the Prometheus Pushgateway at
+// url after each collection. Each push replaces all metrics of the job and
+// instance, so that series of removed devices don't linger.
+func startPushgatewayExporter(url, instance string) (Sink, func(), error) {
+	reg := prom.NewRegistry()
+	if _, err := prometheus.NewExporter(prometheus.Options{
+		Registry: reg,
+		OnError: func(err error) {
+			slog.Error("pushgateway exporter error", "err", err)
+		},
+	}); err != nil {
+		return nil, nil, err
+	}
+	pusher := push.New(url, "home-ac-stats").
+		Client(httpClient).
+		Gatherer(reg).
+		Grouping("instance", instance)
+	return sinkFunc(func(context.Context, CollectionResult) error {
+		if err := pusher.Push(); err != nil {
+			return fmt.Errorf("failed to push to pushgateway: %w", err)
+		}
+		return nil
+	}), func() {}, nil
+}
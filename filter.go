@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// Room filters, matched case-insensitively against sanitized room names. If
+// includeRooms is set, excludeRooms is ignored.
+var includeRooms, excludeRooms []string
+
+// Device ID filters, matched exactly. If includeDeviceIDs is set,
+// excludeDeviceIDs is ignored.
+var includeDeviceIDs, excludeDeviceIDs []string
+
+// sanitizeList sanitizes each non-blank entry of list.
+func sanitizeList(list []string) []string {
+	var out []string
+	for _, s := range list {
+		if strings.TrimSpace(s) != "" {
+			out = append(out, sanitizeString(s))
+		}
+	}
+	return out
+}
+
+// trimList trims the entries of list, dropping blank ones.
+func trimList(list []string) []string {
+	var out []string
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// filterDevices returns the devices that pass both the room and the device ID
+// filters.
+func filterDevices(devices []DeviceInfo) []DeviceInfo {
+	if len(includeRooms) == 0 && len(excludeRooms) == 0 &&
+		len(includeDeviceIDs) == 0 && len(excludeDeviceIDs) == 0 {
+		return devices
+	}
+	var out []DeviceInfo
+	for _, d := range devices {
+		if roomAllowed(sanitizeString(d.Room.Name)) && deviceIDAllowed(d.ID) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func roomAllowed(room string) bool {
+	if len(includeRooms) > 0 {
+		return containsFold(includeRooms, room)
+	}
+	return !containsFold(excludeRooms, room)
+}
+
+func deviceIDAllowed(id string) bool {
+	if len(includeDeviceIDs) > 0 {
+		return slices.Contains(includeDeviceIDs, id)
+	}
+	return !slices.Contains(excludeDeviceIDs, id)
+}
+
+func containsFold(list []string, s string) bool {
+	return slices.ContainsFunc(list, func(v string) bool { return strings.EqualFold(v, s) })
+}
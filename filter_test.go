@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterDevices(t *testing.T) {
+	device := func(id, room string) DeviceInfo {
+		var d DeviceInfo
+		d.ID, d.Room.Name = id, room
+		return d
+	}
+	devices := []DeviceInfo{
+		device("a1", "Living Room"),
+		device("b2", "Bedroom"),
+		device("c3", "Bedroom"),
+		device("d4", "Office"),
+	}
+	tests := []struct {
+		name                           string
+		inRooms, exRooms, inIDs, exIDs []string
+		want                           []string
+	}{
+		{"no filters", nil, nil, nil, nil, []string{"a1", "b2", "c3", "d4"}},
+		{"include rooms, sanitized and case-insensitive", []string{"living room", "BEDROOM"}, nil, nil, nil, []string{"a1", "b2", "c3"}},
+		{"exclude rooms", nil, []string{"Bedroom"}, nil, nil, []string{"a1", "d4"}},
+		{"include rooms takes precedence over exclude rooms", []string{"Bedroom"}, []string{"Bedroom"}, nil, nil, []string{"b2", "c3"}},
+		{"include IDs", nil, nil, []string{"a1", "d4"}, nil, []string{"a1", "d4"}},
+		{"exclude IDs", nil, nil, nil, []string{"c3"}, []string{"a1", "b2", "d4"}},
+		{"include IDs takes precedence over exclude IDs", nil, nil, []string{"c3"}, []string{"c3"}, []string{"c3"}},
+		{"IDs are matched exactly", nil, nil, []string{"A1"}, nil, nil},
+		{"must pass both room and ID filters", []string{"Bedroom"}, nil, nil, []string{"b2"}, []string{"c3"}},
+		{"included ID in an excluded room", nil, []string{"Office"}, []string{"d4", "a1"}, nil, []string{"a1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &includeRooms, sanitizeList(tt.inRooms))
+			setVar(t, &excludeRooms, sanitizeList(tt.exRooms))
+			setVar(t, &includeDeviceIDs, tt.inIDs)
+			setVar(t, &excludeDeviceIDs, tt.exIDs)
+			var got []string
+			for _, d := range filterDevices(devices) {
+				got = append(got, d.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+)
+
+// geocodingBaseURL is the base URL of the open-meteo geocoding API, overridden
+// by tests.
+var geocodingBaseURL = "https://geocoding-api.open-meteo.com/v1"
+
+// geocodeCacheEntry is the resolved coordinates of a city, saved next to the
+// weather cache so that restarts don't depend on the geocoding API.
+type geocodeCacheEntry struct {
+	City string `json:"city"`
+	Lat  string `json:"lat"`
+	Lon  string `json:"lon"`
+}
+
+// geocodeCity returns the coordinates of the best match for city, formatted
+// with precision decimals.
+func geocodeCity(ctx context.Context, city string, precision int) (geocodeCacheEntry, error) {
+	url := fmt.Sprintf("%s/search?name=%s&count=1&format=json", geocodingBaseURL, neturl.QueryEscape(city))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return geocodeCacheEntry{}, fmt.Errorf("failed to create geocoding request: %w", err)
+	}
+	var rv struct {
+		Results []struct {
+			Name      string  `json:"name"`
+			Country   string  `json:"country"`
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
+		} `json:"results"`
+	}
+	// Geocoding happens once at startup, so it is left out of the weather
+	// request latencies.
+	if err := fetchJSONWithLatency(req, "geocoding", nil, &rv); err != nil {
+		return geocodeCacheEntry{}, err
+	}
+	if len(rv.Results) == 0 {
+		return geocodeCacheEntry{}, fmt.Errorf("no place named %q found", city)
+	}
+	r := rv.Results[0]
+	slog.Info("resolved WEATHER_CITY", "city", city, "match", r.Name, "country", r.Country)
+	return geocodeCacheEntry{
+		City: city,
+		Lat:  strconv.FormatFloat(r.Latitude, 'f', precision, 64),
+		Lon:  strconv.FormatFloat(r.Longitude, 'f', precision, 64),
+	}, nil
+}
+
+// resolveCity sets the coordinates of l from its city, from cacheFile if it
+// has them, otherwise by geocoding (and saving them to cacheFile, if not
+// empty). If geocoding fails, l keeps its explicit coordinates.
+func resolveCity(ctx context.Context, l *weatherLocation, precision int, cacheFile string) {
+	var e geocodeCacheEntry
+	cached := false
+	if cacheFile != "" {
+		if b, err := os.ReadFile(cacheFile); err == nil && json.Unmarshal(b, &e) == nil && e.City == l.city {
+			cached = true
+		}
+	}
+	if !cached {
+		var err error
+		if e, err = geocodeCity(ctx, l.city, precision); err != nil {
+			slog.Warn("failed to geocode WEATHER_CITY, using WEATHER_LAT and WEATHER_LON", "city", l.city,
+				"lat", l.Lat, "lon", l.Lon, "err", err)
+			return
+		}
+		if cacheFile != "" {
+			if b, err := json.Marshal(e); err != nil {
+				slog.Warn("failed to encode geocoding cache", "err", err)
+			} else if err := writeFileAtomic(cacheFile, b); err != nil {
+				slog.Warn("failed to write geocoding cache", "err", err)
+			}
+		}
+	}
+	l.Lat, l.Lon = e.Lat, e.Lon
+	slog.Info("using the coordinates of WEATHER_CITY", "city", l.city, "lat", l.Lat, "lon", l.Lon, "cached", cached)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opencensus.io/stats/view"
+)
+
+// fakeGeocoding points geocodingBaseURL at a server answering name searches
+// with results, a JSON array, for the duration of the test.
+func fakeGeocoding(t *testing.T, results string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/search" || r.URL.Query().Get("name") == "" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"results":%s}`, results)
+	}))
+	t.Cleanup(srv.Close)
+	setVar(t, &geocodingBaseURL, srv.URL)
+}
+
+func TestGeocodeCity(t *testing.T) {
+	for _, tc := range []struct {
+		name, results string
+		want          geocodeCacheEntry
+		wantErr       string
+	}{
+		{
+			name:    "resolved",
+			results: `[{"name":"Seattle","country":"United States","latitude":47.60621,"longitude":-122.33207}]`,
+			want:    geocodeCacheEntry{City: "Seattle", Lat: "47.61", Lon: "-122.33"},
+		},
+		{
+			name:    "not found",
+			results: `[]`,
+			wantErr: `no place named "Seattle" found`,
+		},
+		{
+			name: "multiple results",
+			results: `[{"name":"Seattle","country":"United States","latitude":47.60621,"longitude":-122.33207},
+				{"name":"Seattle","country":"Canada","latitude":49.1,"longitude":-123.1}]`,
+			want: geocodeCacheEntry{City: "Seattle", Lat: "47.61", Lon: "-122.33"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeGeocoding(t, tc.results)
+			got, err := geocodeCity(context.Background(), "Seattle", 2)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("err = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGeocodeCityLatency(t *testing.T) {
+	registerTestViews(t)
+	fakeGeocoding(t, `[{"name":"Seattle","latitude":47.6,"longitude":-122.3}]`)
+	if _, err := geocodeCity(context.Background(), "Seattle", 2); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := view.RetrieveData("weather_request_duration_ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 0 {
+		t.Errorf("geocoding recorded weather request latencies: %v", rows)
+	}
+}
+
+func TestResolveCity(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "weather.json.city")
+	fakeGeocoding(t, `[{"name":"Seattle","latitude":47.60621,"longitude":-122.33207}]`)
+	l := weatherLocation{Lat: "1", Lon: "2", city: "Seattle"}
+	resolveCity(context.Background(), &l, 2, cacheFile)
+	if l.Lat != "47.61" || l.Lon != "-122.33" {
+		t.Errorf("coordinates = %s,%s, want 47.61,-122.33", l.Lat, l.Lon)
+	}
+
+	// The cached coordinates are used once the API is down, and the explicit
+	// ones without a cache.
+	setVar(t, &weatherMaxAttempts, 1)
+	setVar(t, &geocodingBaseURL, "http://127.0.0.1:1")
+	l = weatherLocation{Lat: "1", Lon: "2", city: "Seattle"}
+	resolveCity(context.Background(), &l, 2, cacheFile)
+	if l.Lat != "47.61" || l.Lon != "-122.33" {
+		t.Errorf("cached coordinates = %s,%s, want 47.61,-122.33", l.Lat, l.Lon)
+	}
+	logs := captureLogs(t)
+	l = weatherLocation{Lat: "1", Lon: "2", city: "Seattle"}
+	resolveCity(context.Background(), &l, 2, "")
+	if l.Lat != "1" || l.Lon != "2" {
+		t.Errorf("coordinates without a cache = %s,%s, want the explicit 1,2", l.Lat, l.Lon)
+	}
+	if want := "failed to geocode WEATHER_CITY"; !strings.Contains(logs.String(), want) {
+		t.Errorf("logs = %q, want %q", logs, want)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// health tracks collection outcomes for the liveness and readiness probes.
+type health struct {
+	interval time.Duration
+
+	mu          sync.Mutex
+	lastSuccess time.Time
+}
+
+func (h *health) markSuccess(t time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSuccess = t
+}
+
+// ready reports whether a collection succeeded within the last two intervals.
+func (h *health) ready(now time.Time) (bool, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastSuccess.IsZero() {
+		return false, "no successful collection yet"
+	}
+	if age := now.Sub(h.lastSuccess); age > 2*h.interval {
+		return false, fmt.Sprintf("last successful collection was %v ago", age.Round(time.Second))
+	}
+	return true, "ok"
+}
+
+func (h *health) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ok, msg := h.ready(time.Now())
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintln(w, msg)
+	})
+	return mux
+}
+
+// bindTimeout bounds the retries of binding the address of a server, e.g.
+// while the previous instance still holds the port during a rolling restart.
+const bindTimeout = time.Minute
+
+// serverErrs receives the errors of servers that failed to bind, which make
+// run return. It is created by run.
+var serverErrs chan error
+
+// startHTTPServer serves handler on addr in the background and returns a
+// function that shuts the server down. name identifies the server in logs.
+// Collection carries on while binding addr is retried; if it can't be bound
+// within bindTimeout, the error is sent to serverErrs.
+func startHTTPServer(name, addr string, handler http.Handler) (stop func()) {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := serverErrs
+	go func() {
+		ln, err := listenWithRetry(ctx, name, addr)
+		if err != nil {
+			if ctx.Err() == nil {
+				select {
+				case errs <- fmt.Errorf("%s server is unavailable: %w", name, err):
+				default: // run already returned
+				}
+			}
+			return
+		}
+		slog.Info("serving "+name, "addr", ln.Addr().String())
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error(name+" server error", "err", err)
+		}
+	}()
+	return func() {
+		cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("failed to shut down "+name+" server", "err", err)
+		}
+	}
+}
+
+// listenWithRetry listens on addr, retrying with exponential backoff for up to
+// bindTimeout or until ctx is done.
+func listenWithRetry(ctx context.Context, name, addr string) (net.Listener, error) {
+	deadline := time.Now().Add(bindTimeout)
+	for attempt := 1; ; attempt++ {
+		ln, err := net.Listen("tcp", addr)
+		if err == nil {
+			return ln, nil
+		}
+		delay := backoff(attempt)
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("failed to listen on %s for %v: %w", addr, bindTimeout, err)
+		}
+		slog.Warn("failed to listen, retrying", "server", name, "addr", addr, "attempt", attempt,
+			"delay", delay.Round(time.Millisecond), "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+// influx is the destination of the influx exporter, or nil if it is not
+// enabled. Backfill writes to it too.
+var influx *influxWriter
+
+// influxWriter writes the view data to InfluxDB using the v2 write API, which
+// InfluxDB 1.8+ also serves.
+type influxWriter struct {
+	url   string // full write endpoint, including the query
+	token string
+}
+
+func newInfluxWriter(baseURL, bucket, org, token string) *influxWriter {
+	q := url.Values{"bucket": {bucket}, "precision": {"s"}}
+	if org != "" {
+		q.Set("org", org)
+	}
+	return &influxWriter{
+		url:   strings.TrimSuffix(baseURL, "/") + "/api/v2/write?" + q.Encode(),
+		token: token,
+	}
+}
+
+// write sends the current data of all views as a single batch.
+func (w *influxWriter) write(ctx context.Context, now time.Time) error {
+	return w.post(ctx, influxLines(now))
+}
+
+// Record writes the current data of all views, at the time of r.
+func (w *influxWriter) Record(ctx context.Context, r CollectionResult) error {
+	if err := w.write(ctx, r.Time); err != nil {
+		return fmt.Errorf("failed to write to influx: %w", err)
+	}
+	return nil
+}
+
+// post sends points in line protocol.
+func (w *influxWriter) post(ctx context.Context, body []byte) error {
+	if len(body) == 0 {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return wrapHTTPError("influx", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influx write failed code=%d error=%s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// influxLines returns the data of all views in line protocol: one point per
+// view row, named after the view, with the row's tags and its aggregated
+// value as fields.
+func influxLines(now time.Time) []byte {
+	var b bytes.Buffer
+	for _, v := range views {
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			slog.Warn("failed to read view", "view", v.Name, "err", err)
+			continue
+		}
+		for _, row := range rows {
+			b.WriteString(influxEscaper.Replace(v.Name))
+			for _, t := range row.Tags {
+				if t.Value == "" {
+					continue // not allowed in line protocol
+				}
+				fmt.Fprintf(&b, ",%s=%s", influxEscaper.Replace(t.Key.Name()), influxEscaper.Replace(t.Value))
+			}
+			fmt.Fprintf(&b, " %s %d\n", influxFields(row.Data), now.Unix())
+		}
+	}
+	return b.Bytes()
+}
+
+func influxFields(data view.AggregationData) string {
+	switch d := data.(type) {
+	case *view.LastValueData:
+		return fmt.Sprintf("value=%g", d.Value)
+	case *view.SumData:
+		return fmt.Sprintf("value=%g", d.Value)
+	case *view.CountData:
+		return fmt.Sprintf("value=%di", d.Value)
+	case *view.DistributionData:
+		return fmt.Sprintf("count=%di,sum=%g,mean=%g,min=%g,max=%g", d.Count, d.Sum(), d.Mean, d.Min, d.Max)
+	default:
+		return fmt.Sprintf("value=%q", fmt.Sprint(data))
+	}
+}
+
+// influxEscaper escapes measurement names, tag keys and tag values.
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// stdout is where the jsonlines exporter writes. It is a variable so that the
+// output can be captured.
+var stdout io.Writer = os.Stdout
+
+// writeJSONLines writes the readings of a collection cycle as a single JSON
+// line to w.
+func writeJSONLines(w io.Writer, r CollectionResult) error {
+	return json.NewEncoder(w).Encode(r)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// deviceLastSeen tracks devices that dropped out of the device list, or is
+// nil outside of daemon mode.
+var deviceLastSeen *lastSeenTracker
+
+// lastSeenTracker remembers when each device was last listed, to report
+// devices that disappeared for up to a grace period.
+type lastSeenTracker struct {
+	grace time.Duration
+
+	mu      sync.Mutex
+	devices map[string]*seenDevice // by device ID
+}
+
+type seenDevice struct {
+	account, room string // sanitized room name
+	last          time.Time
+	missing       bool
+}
+
+// missingDevice is a device that is not listed anymore.
+type missingDevice struct {
+	id, account, room string
+	age               time.Duration // since it was last listed
+	new               bool          // first collection it is missing in
+}
+
+func newLastSeenTracker(grace time.Duration) *lastSeenTracker {
+	return &lastSeenTracker{grace: grace, devices: make(map[string]*seenDevice)}
+}
+
+// update records that devices are listed at now, and returns the devices that
+// were listed before but not anymore, within the grace period. Devices of
+// accounts not in listed, whose listing failed, are neither. reset reports
+// whether a device stopped being missing, as it reappeared or passed the grace
+// period and was forgotten.
+func (t *lastSeenTracker) update(devices []DeviceInfo, listed []string, now time.Time) (missing []missingDevice, reset bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	present := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		present[d.ID] = true
+		if prev, ok := t.devices[d.ID]; ok && prev.missing {
+			reset = true
+		}
+		t.devices[d.ID] = &seenDevice{account: d.Account, room: sanitizeString(d.Room.Name), last: now}
+	}
+	for id, d := range t.devices {
+		if present[id] || !slices.Contains(listed, d.account) {
+			continue
+		}
+		age := now.Sub(d.last)
+		if age > t.grace {
+			delete(t.devices, id)
+			reset = true
+			continue
+		}
+		missing = append(missing, missingDevice{id: id, account: d.account, room: d.room, age: age, new: !d.missing})
+		d.missing = true
+	}
+	return missing, reset
+}
+
+// recordMissingDevices records device_last_seen_seconds of the missing devices,
+// and counts the ones that disappeared since the previous collection. Once a
+// device is not missing anymore, the view is reset so that its series is not
+// exported anymore.
+func recordMissingDevices(ctx context.Context, devices []DeviceInfo, listed []string) {
+	missing, reset := deviceLastSeen.update(devices, listed, time.Now())
+	if reset {
+		for _, v := range views {
+			if v.Measure == deviceLastSeenAge {
+				view.Unregister(v)
+				if err := view.Register(v); err != nil {
+					slog.Warn("failed to reset the view of disappeared devices", "err", err)
+				}
+			}
+		}
+	}
+	for _, d := range missing {
+		if d.new {
+			slog.Warn("device disappeared from the device list", "device_id", d.id, "room", d.room, "account", d.account)
+		}
+		ms := []stats.Measurement{deviceLastSeenAge.M(d.age.Seconds())}
+		if d.new {
+			ms = append(ms, devicesDisappeared.M(1))
+		}
+		if err := stats.RecordWithTags(ctx,
+			[]tag.Mutator{
+				tag.Upsert(accountKey, d.account),
+				tag.Upsert(roomKey, d.room),
+				tag.Upsert(deviceIDKey, d.id),
+			},
+			ms...,
+		); err != nil {
+			slog.Warn("failed to record disappeared device", "device_id", d.id, "err", err)
+		}
+	}
+}
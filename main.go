@@ -2,162 +2,889 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"hash/fnv"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"contrib.go.opencensus.io/exporter/stackdriver"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
+	"golang.org/x/text/unicode/norm"
 )
 
 func main() {
-	defer func() { fmt.Println("success") }()
-	apiKey := os.Getenv("SENSIBO_API_KEY")
-	if apiKey == "" {
-		log.Fatal("SENSIBO_API_KEY not set")
-	}
-	outsideTempMetric := stats.Float64("outside_temp", "Outside temperature in Celsius", "C")
-	roomTemp := stats.Float64("room_temp", "The room temperature in Celsius", "C")
-	acState := stats.Int64("ac_state", "AC state (on=1, off=0)", "state")
-	roomKey := tag.MustNewKey("room")
-
-	if err := view.Register(
-		&view.View{
-			Measure:     outsideTempMetric,
-			Aggregation: view.LastValue()},
-		&view.View{
-			Measure:     roomTemp,
-			Aggregation: view.LastValue(),
-			TagKeys:     []tag.Key{roomKey}},
-		&view.View{
-			Measure:     acState,
-			Aggregation: view.LastValue(),
-			TagKeys:     []tag.Key{roomKey}}); err != nil {
-		log.Fatal(err)
-	}
-
-	exporter, err := stackdriver.NewExporter(stackdriver.Options{
-		ProjectID:               os.Getenv("GOOGLE_PROJECT"),
-		DefaultMonitoringLabels: &stackdriver.Labels{}, // remove default labels
-		OnError: func(err error) {
-			log.Printf("stackdriver exporter error: %v", err)
-		},
-	})
-	if err != nil {
-		log.Fatal(err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:])
+	stop()
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return // the usage was printed
+	case errors.Is(err, errVersion):
+		fmt.Println(versionString())
+		return
+	case err != nil:
+		slog.Error(err.Error())
+		os.Exit(1)
 	}
-	defer exporter.Flush()
+	fmt.Fprintln(os.Stderr, "success") // stdout is reserved for the jsonlines exporter
+}
 
-	if err := exporter.StartMetricsExporter(); err != nil {
-		log.Fatalf("error starting metric exporter: %v", err)
+// run collects metrics until ctx is cancelled, or once if no scrape interval
+// is configured. args are the command-line arguments, without the program
+// name.
+func run(ctx context.Context, args []string) error {
+	cfg, err := LoadConfig(args)
+	if err != nil {
+		return err
+	}
+	resetState()
+	serverErrs = make(chan error, 2) // the prometheus and health servers
+	if err := setupLogging(cfg.LogFormat, cfg.LogLevel); err != nil {
+		return err
+	}
+	slog.Info("starting", "version", versionString())
+	sanitizeFallback, sanitizeHash = cfg.SanitizeFallback, cfg.SanitizeHash
+	accounts := parseAccounts(cfg.SensiboAPIKeys, cfg.SensiboAccountNames)
+	for i, l := range cfg.WeatherLocations {
+		cfg.WeatherLocations[i].Name = sanitizeString(l.Name)
+	}
+	if cfg.WebhookURL != "" && !cfg.DryRun {
+		alerts = newAlerter(cfg.WebhookURL, alertThresholds{Min: cfg.AlertMinTemp, Max: cfg.AlertMaxTemp}, cfg.AlertRooms)
+	}
+	includeRooms, excludeRooms = sanitizeList(cfg.IncludeRooms), sanitizeList(cfg.ExcludeRooms)
+	includeDeviceIDs, excludeDeviceIDs = trimList(cfg.IncludeDeviceIDs), trimList(cfg.ExcludeDeviceIDs)
+	weatherProvider = cfg.WeatherProvider
+	weatherTimezone = cfg.WeatherTimezone
+	weatherForecastHours, _ = parseWeatherMode(cfg.WeatherMode) // validated by LoadConfig
+	weatherCacheFile = cfg.WeatherCacheFile
+	weatherCacheTTL = cfg.WeatherCacheTTL
+	maxConcurrency = cfg.MaxConcurrency
+	measurementAgeWarning = cfg.MeasurementAgeWarning
+	maxMeasurementAge = cfg.MaxMeasurementAge
+	httpClient.Timeout = cfg.HTTPTimeout
+	sensiboMaxAttempts = cfg.SensiboMaxRetries
+	sensiboFields = trimList(cfg.SensiboFields)
+	sensiboAPIKeyHeader = cfg.SensiboAPIKeyHeader
+	roomMeasurementKinds = trimList(cfg.RoomMeasurements)
+	sensiboStrict = cfg.SensiboStrict
+	dualUnits = cfg.DualUnits
+	detailedPoll = cfg.DetailedPoll
+	weatherMaxAttempts = cfg.WeatherMaxRetries
+	if cfg.ProxyURL != "" {
+		if err := setProxy(cfg.ProxyURL); err != nil {
+			return fmt.Errorf("invalid proxy_url: %w", err)
+		}
+	}
+	if cfg.CACertFile != "" || cfg.InsecureSkipVerify {
+		if cfg.InsecureSkipVerify {
+			slog.Warn("INSECURE_SKIP_VERIFY is set, TLS certificates are not verified")
+		}
+		if err := setTLSConfig(cfg.CACertFile, cfg.InsecureSkipVerify); err != nil {
+			return err
+		}
+	}
+	sensiboLimiter = newLimiter(cfg.SensiboRate)
+	weatherLimiter = newLimiter(cfg.WeatherRate)
+	for i, l := range cfg.WeatherLocations {
+		if l.city != "" && !cfg.DisableOutsideTemp {
+			var cacheFile string
+			if cfg.WeatherCacheFile != "" {
+				cacheFile = cfg.WeatherCacheFile + ".city"
+			}
+			resolveCity(ctx, &cfg.WeatherLocations[i], cfg.WeatherCoordPrecision, cacheFile)
+		}
+	}
+	enableAirQuality = cfg.EnableAirQuality
+	disableOutsideTemp = cfg.DisableOutsideTemp
+	expectedDeviceCount = cfg.ExpectedDeviceCount
+	if temperatureUnit, err = parseTempUnit(cfg.TempUnit); err != nil {
+		return err
+	}
+	dryRun, interval := cfg.DryRun, cfg.ScrapeInterval
+	if cfg.hasSink("stackdriver") && cfg.GoogleProject == "" && !dryRun {
+		if err := cfg.resolveGoogleProject(ctx); err != nil {
+			return err
+		}
 	}
-	defer exporter.StopMetricsExporter()
 
-	devices, err := GetDevices(apiKey)
-	if err != nil {
-		log.Fatal(err)
+	if cfg.ReportingPeriod > 0 {
+		view.SetReportingPeriod(cfg.ReportingPeriod)
+		if interval > 0 && cfg.ReportingPeriod > interval {
+			slog.Warn("REPORTING_PERIOD is longer than SCRAPE_INTERVAL, some collections won't be exported",
+				"reporting_period", cfg.ReportingPeriod, "interval", interval)
+		}
+	}
+	var metricPrefix string
+	for _, name := range cfg.sinkNames() {
+		if slices.Contains(metricPrefixExporters, name) {
+			metricPrefix = cfg.MetricPrefix
+		}
+	}
+	if err := registerViews(temperatureUnit, !disableOutsideTemp, metricPrefix); err != nil {
+		return fmt.Errorf("failed to register views: %w", err)
+	}
+	defer view.Unregister(views...) // so that run can be called again (see resetState)
+	if cfg.hasSink("stackdriver") {
+		// Fail fast rather than silently missing the series of a bad name.
+		if err := validateStackdriverNames(views); err != nil {
+			return err
+		}
 	}
 
-	outsideTemp, outsideTempErr := getTemperature()
-	if outsideTempErr != nil {
-		log.Printf("warn: failed to get outside temperature: %v", outsideTempErr)
+	var sinks []namedSink
+	if dryRun {
+		slog.Info("dry-run: metrics will be logged, not exported")
 	} else {
-		log.Println("outside_temp", outsideTemp)
-		stats.Record(context.TODO(), outsideTempMetric.M(outsideTemp))
+		if slices.Contains(cfg.sinkNames(), "prometheus") && interval == 0 {
+			slog.Warn("prometheus exporter without SCRAPE_INTERVAL exits before it can be scraped")
+		}
+		var stopSinks func()
+		if sinks, stopSinks, err = startSinks(ctx, cfg); err != nil {
+			return err
+		}
+		defer stopSinks()
+	}
+	if cfg.BackfillHours > 0 && !dryRun {
+		logBackfill(ctx, accounts, cfg.BackfillHours)
+	}
+
+	if interval > 0 {
+		// Allow for one missed collection before a gap is not counted.
+		acRuntime = newRuntimeTracker(2 * interval)
+		acEnergy = newEnergyTracker(2 * interval)
+		if cfg.EMAAlpha > 0 {
+			roomTempEMA = newEMATracker(cfg.EMAAlpha, 2*interval)
+		}
+		if cfg.ACRuntimeStateFile != "" {
+			if err := acRuntime.load(cfg.ACRuntimeStateFile); err != nil {
+				return err
+			}
+		}
+		deviceLastSeen = newLastSeenTracker(cfg.DeviceGracePeriod)
+		roomTempDaily = newDailyTracker(time.Local, temperatureUnit)
+		if cfg.DailyStateFile != "" {
+			if err := roomTempDaily.load(cfg.DailyStateFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	h := &health{interval: interval}
+	if cfg.HealthPort != "" && interval > 0 {
+		defer startHTTPServer("health probes", ":"+cfg.HealthPort, h.handler())()
+	}
+
+	cycleTimeout := cfg.CycleTimeout
+	if cycleTimeout == 0 {
+		cycleTimeout = interval
+	}
+	collect := func() error {
+		cycleCtx, cancel := ctx, func() {}
+		if cycleTimeout > 0 {
+			cycleCtx, cancel = context.WithTimeout(ctx, cycleTimeout)
+		}
+		stats.Record(ctx, up.M(1), startTime.M(processStart.Unix()))
+		cycleStart := time.Now()
+		result, err := collectOnce(cycleCtx, accounts, cfg.WeatherLocations)
+		if errors.Is(cycleCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w after %v: %w", errCycleTimeout, cycleTimeout, err)
+		}
+		cancel()
+		// Recorded before the sinks run, so that the sinks that export the
+		// views after each collection include it.
+		recordLatency(ctx, cycleDuration, cycleStart, err)
+		if dryRun {
+			logViewData()
+		} else if result != nil {
+			err = errors.Join(err, recordSinks(ctx, sinks, *result))
+		}
+		if acRuntime != nil && cfg.ACRuntimeStateFile != "" {
+			if err := acRuntime.save(cfg.ACRuntimeStateFile); err != nil {
+				slog.Warn("failed to save runtime state", "err", err)
+			}
+		}
+		if roomTempDaily != nil && cfg.DailyStateFile != "" {
+			if err := roomTempDaily.save(cfg.DailyStateFile); err != nil {
+				slog.Warn("failed to save daily state", "err", err)
+			}
+		}
+		if err == nil {
+			h.markSuccess(time.Now())
+		}
+		return err
+	}
+
+	if interval == 0 {
+		return collect()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	slog.Info("collecting periodically", "interval", interval)
+	// Collections run in the background, one at a time: ticks that fire while
+	// one is running are skipped.
+	finished := make(chan struct{})
+	start := func() {
+		go func() {
+			if err := collect(); err != nil {
+				if ctx.Err() != nil {
+					slog.Info("collection interrupted by shutdown", "err", err)
+				} else if errors.Is(err, errCycleTimeout) {
+					slog.Warn("collection aborted, waiting for the next tick", "err", err)
+				} else {
+					slog.Error("collection failed", "err", err)
+				}
+			}
+			finished <- struct{}{}
+		}()
 	}
+	start()
+	running := true
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("received signal, shutting down")
+			if running {
+				<-finished
+			}
+			return nil
+		case err := <-serverErrs:
+			if running {
+				<-finished
+			}
+			return err
+		case <-finished:
+			running = false
+		case <-ticker.C:
+			if running {
+				slog.Warn("previous collection is still running, skipped this one")
+				stats.Record(ctx, collectionSkipped.M(1))
+				continue
+			}
+			start()
+			running = true
+		}
+	}
+}
 
+// resetState clears the state that run only sets up for some configurations,
+// so that a run doesn't inherit it from a previous one. The other settings
+// are assigned from the configuration by each run.
+func resetState() {
+	alerts = nil
+	acRuntime, acEnergy, roomTempEMA, roomTempDaily, deviceLastSeen = nil, nil, nil, nil, nil
+	influx, csvOut = nil, nil
+	staleWeather = nil
+	httpTransport.Proxy = http.ProxyFromEnvironment
+	httpTransport.TLSClientConfig = nil
+	httpTransport.CloseIdleConnections()
+	unknownFieldsLogged.Range(func(k, _ any) bool {
+		unknownFieldsLogged.Delete(k)
+		return true
+	})
+}
+
+// setupLogging configures the default logger. format is "text" (default) or
+// "json"; level is one of "debug", "info" (default), "warn" or "error".
+func setupLogging(format, level string) error {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL=%q: %w", level, err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch format {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT=%q (supported: text, json)", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// processStart is when the program started.
+var processStart = time.Now()
+
+// errCycleTimeout is returned by collections that were aborted after the cycle
+// timeout.
+var errCycleTimeout = errors.New("collection timed out")
+
+// collectOnce fetches the current device and weather readings and records
+// them. The result is nil if there are no readings for the sinks, i.e. if the
+// devices of all accounts failed or the collection was canceled.
+func collectOnce(ctx context.Context, accounts []sensiboAccount, locations []weatherLocation) (*CollectionResult, error) {
+	var devices []DeviceInfo
+	var failed int
+	var listed []string // accounts whose devices were listed
+	for _, a := range accounts {
+		ds, err := GetDevices(ctx, a.APIKey)
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("collection canceled: %w", ctx.Err())
+		}
+		if err != nil {
+			slog.Error("failed to get devices", "account", a.Name, "err", err)
+			failed++
+			continue
+		}
+		if err := stats.RecordWithTags(ctx,
+			[]tag.Mutator{tag.Upsert(accountKey, a.Name)},
+			devicesTotal.M(int64(len(ds))),
+		); err != nil {
+			slog.Warn("failed to record device count", "account", a.Name, "err", err)
+		}
+		listed = append(listed, a.Name)
+		for i := range ds {
+			ds[i].Account = a.Name
+			ds[i].Measurements.Temperature = temperatureUnit.fromCelsius(ds[i].Measurements.Temperature)
+			temperatureUnit.convertPtr(celsius, ds[i].ACState.TargetTemperature)
+			temperatureUnit.convertPtr(celsius, ds[i].Measurements.FeelsLike)
+		}
+		devices = append(devices, ds...)
+	}
+	if failed == len(accounts) {
+		return nil, fmt.Errorf("failed to get devices for all %d account(s)", failed)
+	}
+	if expectedDeviceCount > 0 && failed == 0 && len(devices) != expectedDeviceCount {
+		slog.Warn("unexpected number of devices", "found", len(devices), "expected", expectedDeviceCount)
+	}
+	if filtered := filterDevices(devices); len(filtered) < len(devices) {
+		slog.Info("filtered out devices", "filtered", len(devices)-len(filtered), "remaining", len(filtered))
+		devices = filtered
+	}
+	if deviceLastSeen != nil {
+		recordMissingDevices(ctx, devices, listed)
+	}
+
+	// The outside temperature of the first location goes to the sinks.
+	var outsideTemp *float64
+	var freshOutsideTemp bool
+	weather := make([]fetchedWeather, len(locations))
+	if !disableOutsideTemp {
+		for i, l := range locations {
+			cacheFile := weatherCacheFile
+			if cacheFile != "" && len(locations) > 1 {
+				cacheFile += "." + l.Name
+			}
+			weather[i] = fetchWeather(ctx, l, cacheFile)
+		}
+		resetStaleWeather(locations, weather)
+	}
+	for i, l := range locations {
+		if w := weather[i]; w.ok {
+			recordWeather(ctx, l, w.Weather, w.stale)
+			if i == 0 {
+				outsideTemp = &weather[i].Temperature
+				freshOutsideTemp = !w.stale
+			}
+		}
+		if enableAirQuality {
+			collectAirQuality(ctx, l)
+		}
+	}
+
+	result := &CollectionResult{
+		Time:        time.Now(),
+		OutsideTemp: outsideTemp,
+		Devices:     make([]DeviceReading, 0, len(devices)),
+	}
+	if len(locations) > 0 {
+		result.Location = locations[0].Name
+	}
 	for _, d := range devices {
-		roomName := sanitizeString(d.Room.Name)
-		log.Println("recording "+d.ID, "room="+roomName,
-			"temp="+fmt.Sprintf("%f", d.Measurements.Temperature),
-			"ac="+fmt.Sprintf("%t", d.ACState.On))
-		if err := stats.RecordWithTags(context.TODO(),
-			[]tag.Mutator{tag.Upsert(roomKey, roomName)},
-			roomTemp.M(d.Measurements.Temperature),
-			acState.M(boolToInt(d.ACState.On)),
+		result.Devices = append(result.Devices, newDeviceReading(d))
+	}
+
+	// Devices are recorded concurrently, but logged in order afterwards.
+	errs := forEachDevice(ctx, result.Devices, recordDevice)
+	if outsideTemp != nil && freshOutsideTemp {
+		recordOutsideDelta(ctx, result.Devices, locations[0].Name, *outsideTemp)
+	}
+	var failures []error
+	for i, d := range devices {
+		if errs[i] != nil {
+			failures = append(failures, fmt.Errorf("device %s: %w", d.ID, errs[i]))
+			continue
+		}
+		if !d.Online() {
+			slog.Warn("device is offline, skipped its readings", "device_id", d.ID, "room", sanitizeString(d.Room.Name))
+			continue
+		}
+		if age, ok := d.measurementAge(time.Now()); ok && age > measurementAgeWarning {
+			slog.Warn("device measurements are old, its sensor may be stuck", "device_id", d.ID,
+				"room", sanitizeString(d.Room.Name), "age", age.Round(time.Second))
+		}
+		slog.Info("recorded device", "device_id", d.ID, "room", sanitizeString(d.Room.Name),
+			"temp", d.Measurements.Temperature, "ac_on", d.ACState.On, "mode", d.ACState.Mode)
+	}
+	if alerts != nil {
+		alerts.check(ctx, result.Devices)
+	}
+	if len(failures) > 0 {
+		return result, fmt.Errorf("failed to record %d of %d devices: %w", len(failures), len(devices), errors.Join(failures...))
+	}
+	return result, nil
+}
+
+// fetchedWeather is the outside weather of a location, if ok, in
+// temperatureUnit.
+type fetchedWeather struct {
+	Weather
+	stale, ok bool // stale if read from the cache
+}
+
+// fetchWeather fetches the outside weather at l, falling back to cacheFile (if
+// not empty) when the fetch fails, in which case stale is set. Failures are
+// logged, as the outside weather is best-effort.
+func fetchWeather(ctx context.Context, l weatherLocation, cacheFile string) fetchedWeather {
+	w, weatherErr := getWeather(ctx, l.Lat, l.Lon)
+	if ctx.Err() != nil {
+		slog.Debug("outside temperature fetch canceled", "location", l.Name, "err", weatherErr)
+		return fetchedWeather{}
+	}
+	var stale bool
+	if err := stats.RecordWithTags(ctx,
+		[]tag.Mutator{tag.Upsert(locationKey, l.Name)},
+		weatherFetched.M(boolToInt(weatherErr == nil)),
+	); err != nil {
+		slog.Warn("failed to record weather fetch outcome", "location", l.Name, "err", err)
+	}
+	if cacheFile != "" {
+		now := time.Now()
+		if weatherErr == nil {
+			if err := saveWeatherCache(cacheFile, w, now); err != nil {
+				slog.Warn("failed to save weather cache", "err", err)
+			}
+		} else if cached, ok, err := loadWeatherCache(cacheFile, weatherCacheTTL, now); err != nil {
+			slog.Warn("failed to load weather cache", "err", err)
+		} else if ok {
+			slog.Warn("using cached outside temperature", "location", l.Name, "err", weatherErr)
+			w, weatherErr, stale = cached, nil, true
+		}
+	}
+	if weatherErr != nil {
+		slog.Warn("failed to get outside temperature", "location", l.Name, "err", weatherErr)
+		return fetchedWeather{}
+	}
+	return fetchedWeather{Weather: w.in(temperatureUnit), stale: stale, ok: true}
+}
+
+// staleWeather is the set of locations whose outside weather was last recorded
+// from the cache.
+var staleWeather map[string]bool
+
+// resetStaleWeather resets the outside weather views once the weather of a
+// location recorded from the cache is fetched again, so that its stale="true"
+// series is not exported anymore next to the fresh one. The views are reset
+// before any location is recorded, not to lose the rows of the others.
+func resetStaleWeather(locations []weatherLocation, weather []fetchedWeather) {
+	var reset bool
+	for i, l := range locations {
+		if w := weather[i]; w.ok && !w.stale && staleWeather[l.Name] {
+			reset = true
+		}
+	}
+	if reset {
+		for _, v := range views {
+			if slices.Contains(v.TagKeys, staleKey) {
+				view.Unregister(v)
+				if err := view.Register(v); err != nil {
+					slog.Warn("failed to reset the view of stale weather", "view", v.Name, "err", err)
+				}
+			}
+		}
+		staleWeather = nil
+	}
+	for i, l := range locations {
+		if w := weather[i]; w.ok {
+			if staleWeather == nil {
+				staleWeather = make(map[string]bool)
+			}
+			staleWeather[l.Name] = w.stale
+		}
+	}
+}
+
+// recordWeather records the outside weather w at l, tagged with whether it is
+// stale.
+func recordWeather(ctx context.Context, l weatherLocation, w Weather, stale bool) {
+	slog.Info("recording weather", "location", l.Name, "provider", w.Provider, "temp", w.Temperature, "stale", stale)
+	ms := []stats.Measurement{outsideTempMetric.M(w.Temperature)}
+	if w.Humidity != nil {
+		ms = append(ms, outsideHumidity.M(*w.Humidity))
+	}
+	if w.ApparentTemperature != nil {
+		ms = append(ms, outsideFeelsLike.M(*w.ApparentTemperature))
+	}
+	if err := stats.RecordWithTags(ctx,
+		[]tag.Mutator{
+			tag.Upsert(locationKey, l.Name),
+			tag.Upsert(staleKey, strconv.FormatBool(stale)),
+		},
+		withOtherUnit(ms)...,
+	); err != nil {
+		slog.Warn("failed to record weather", "location", l.Name, "err", err)
+	}
+	if w.Forecast != nil {
+		if err := stats.RecordWithTags(ctx,
+			[]tag.Mutator{
+				tag.Upsert(locationKey, l.Name),
+				tag.Upsert(staleKey, strconv.FormatBool(stale)),
+				tag.Upsert(horizonKey, fmt.Sprintf("%dh", weatherForecastHours)),
+			},
+			withOtherUnit([]stats.Measurement{outsideTempForecast.M(*w.Forecast)})...,
 		); err != nil {
-			log.Fatalf("failed to record measurement for device %s: %s", d.ID, err)
+			slog.Warn("failed to record weather forecast", "location", l.Name, "err", err)
 		}
 	}
 }
 
-func getTemperature() (float64, error) {
-	lat, lon := "47.68", "-122.38"
-	url := fmt.Sprintf("https://api.open-meteo.com/v1/forecast?latitude=%s&longitude=%s&hourly=temperature_2m", lat, lon)
-	resp, err := http.Get(url)
-	if err != nil {
-		return 0, fmt.Errorf("failed to fetch weather: %w", err)
+// disableOutsideTemp disables fetching and recording the outside weather.
+var disableOutsideTemp bool
+
+// expectedDeviceCount is the number of devices expected across all accounts,
+// or 0 if not known.
+var expectedDeviceCount int
+
+// measurementAgeWarning is the age of device measurements above which a
+// warning is logged.
+var measurementAgeWarning = defaultMeasurementAgeWarning
+
+const defaultMeasurementAgeWarning = 15 * time.Minute
+
+// maxMeasurementAge is the age of device measurements above which the room
+// readings are not recorded, or zero to always record them.
+var maxMeasurementAge time.Duration
+
+// maxConcurrency bounds the number of devices processed at once.
+var maxConcurrency = runtime.GOMAXPROCS(0)
+
+// recordOutsideDelta records how much warmer than outside the room of each
+// online device is, given the outside temperature at location.
+func recordOutsideDelta(ctx context.Context, devices []DeviceReading, location string, outsideTemp float64) {
+	for _, r := range devices {
+		if !r.Online || r.Stale {
+			continue
+		}
+		if err := stats.RecordWithTags(ctx,
+			[]tag.Mutator{
+				tag.Upsert(accountKey, r.Account),
+				tag.Upsert(roomKey, r.Room),
+				tag.Upsert(deviceIDKey, r.DeviceID),
+				tag.Upsert(locationKey, location),
+			},
+			withOtherUnit([]stats.Measurement{roomVsOutsideDelta.M(r.Temp - outsideTemp)})...,
+		); err != nil {
+			slog.Warn("failed to record outside temperature delta", "device_id", r.DeviceID, "err", err)
+		}
 	}
-	defer resp.Body.Close()
-	type Response struct {
-		Hourly struct {
-			Temperature2m []float64 `json:"temperature_2m"`
-		} `json:"hourly"`
+}
+
+// forEachDevice calls fn for every device, running at most maxConcurrency calls
+// at once. A failing device does not stop the others; the error of each device
+// is returned in device order.
+func forEachDevice(ctx context.Context, devices []DeviceReading, fn func(context.Context, DeviceReading) error) []error {
+	errs := make([]error, len(devices))
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+	for i, d := range devices {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, d DeviceReading) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = fn(ctx, d)
+		}(i, d)
 	}
-	var rv Response
-	if err := json.NewDecoder(resp.Body).Decode(&rv); err != nil {
-		return 0, fmt.Errorf("failed to decode weather response: %w", err)
+	wg.Wait()
+	return errs
+}
+
+// recordDevice records the measurements of a single device from its reading.
+// Offline devices report their last known readings, so only their
+// connectivity is recorded.
+func recordDevice(ctx context.Context, r DeviceReading) error {
+	d := r.device
+	ms := []stats.Measurement{acOnline.M(boolToInt(r.Online))}
+	if r.Online {
+		ms = append(ms,
+			acState.M(boolToInt(r.ACOn)),
+			acMode.M(acModeCode(r.Mode)),
+			acFanLevel.M(fanLevelCode(d.ACState.FanLevel)),
+		)
+		if r.Stale {
+			slog.Debug("skipped stale room readings", "device_id", r.DeviceID, "room", r.Room,
+				"measured_at", d.Measurements.Time.Time)
+			ms = append(ms, staleReadingSkipped.M(1))
+		} else {
+			ms = append(ms, roomTemp.M(r.Temp))
+			if r.Humidity != nil {
+				ms = append(ms, roomHumidity.M(*r.Humidity))
+			}
+			if d.Measurements.FeelsLike != nil {
+				ms = append(ms, roomFeelsLike.M(*d.Measurements.FeelsLike))
+			}
+			if t := r.TargetTemp; t != nil && r.ACOn {
+				ms = append(ms, acTempDelta.M(r.Temp-*t))
+			}
+			if roomTempEMA != nil {
+				ms = append(ms, roomTempSmoothed.M(roomTempEMA.update(r.DeviceID, r.Temp, time.Now())))
+			}
+			if roomTempDaily != nil {
+				lo, hi := roomTempDaily.update(r.DeviceID, r.Temp, time.Now())
+				ms = append(ms, roomTempDailyMin.M(lo), roomTempDailyMax.M(hi))
+			}
+			if on, ok := d.compressorOn(temperatureUnit); ok {
+				ms = append(ms, acCompressorOn.M(boolToInt(on)))
+			}
+		}
+		if d.ACState.Swing != nil {
+			ms = append(ms, acSwing.M(swingCode(*d.ACState.Swing)))
+		}
+		if t := r.TargetTemp; t != nil {
+			ms = append(ms, acTargetTemp.M(*t))
+		}
+		if d.Measurements.RSSI != nil {
+			ms = append(ms, deviceRSSI.M(*d.Measurements.RSSI))
+		}
+		if d.SmartMode != nil {
+			ms = append(ms, acClimateReact.M(boolToInt(d.SmartMode.Enabled)))
+		}
+		if age, ok := d.measurementAge(time.Now()); ok {
+			ms = append(ms, measurementAge.M(age.Seconds()))
+		}
+		if acRuntime != nil {
+			ms = append(ms, acRuntimeSecs.M(acRuntime.update(r.DeviceID, r.ACOn, time.Now())))
+		}
+		if p := d.Measurements.Power; p != nil {
+			ms = append(ms, acPower.M(*p))
+			if acEnergy != nil {
+				ms = append(ms, acEnergyWh.M(acEnergy.update(r.DeviceID, *p, time.Now())))
+			}
+		}
 	}
-	if len(rv.Hourly.Temperature2m) == 0 {
-		return 0, fmt.Errorf("no temperature data found")
+	if err := stats.RecordWithTags(ctx,
+		[]tag.Mutator{
+			tag.Upsert(accountKey, r.Account),
+			tag.Upsert(roomKey, r.Room),
+			tag.Upsert(deviceIDKey, r.DeviceID),
+		},
+		withOtherUnit(ms)...,
+	); err != nil {
+		return fmt.Errorf("failed to record measurements: %w", err)
+	}
+	if err := stats.RecordWithTags(ctx,
+		[]tag.Mutator{
+			tag.Upsert(deviceIDKey, r.DeviceID),
+			tag.Upsert(modelKey, d.ProductModel),
+			tag.Upsert(firmwareKey, d.FirmwareVersion),
+		},
+		deviceInfo.M(1),
+	); err != nil {
+		return fmt.Errorf("failed to record device info: %w", err)
 	}
-	return rv.Hourly.Temperature2m[0], nil
+	if r.Online && !r.Stale {
+		for kind, v := range d.NumericMeasurements {
+			if err := stats.RecordWithTags(ctx,
+				[]tag.Mutator{
+					tag.Upsert(accountKey, r.Account),
+					tag.Upsert(roomKey, r.Room),
+					tag.Upsert(deviceIDKey, r.DeviceID),
+					tag.Upsert(kindKey, sanitizeString(kind)),
+				},
+				roomMeasurement.M(v),
+			); err != nil {
+				return fmt.Errorf("failed to record measurement %s: %w", kind, err)
+			}
+		}
+	}
+	if b := d.Measurements.Battery; b != nil && r.Online {
+		if err := stats.RecordWithTags(ctx,
+			[]tag.Mutator{tag.Upsert(deviceIDKey, r.DeviceID)},
+			batteryPercent.M(*b),
+		); err != nil {
+			return fmt.Errorf("failed to record battery level: %w", err)
+		}
+	}
+	return nil
 }
 
-func boolToInt(b bool) int64 {
-	if b {
-		return 1
+const defaultHTTPTimeout = 10 * time.Second
+
+// version is the program version, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// versionString describes the build: the version, Go version and, if built
+// from a git checkout, the commit.
+func versionString() string {
+	s := fmt.Sprintf("home-ac-stats %s %s", version, runtime.Version())
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, kv := range info.Settings {
+			if kv.Key == "vcs.revision" {
+				s += " commit " + kv.Value
+			}
+		}
 	}
-	return 0
+	return s
+}
+
+// userAgent identifies us to the upstream APIs.
+func userAgent() string {
+	return "home-ac-stats/" + version + " (+https://github.com/ahmetb/home-ac-stats)"
 }
 
-func GetDevices(apiKey string) ([]DeviceInfo, error) {
-	resp, err := http.Get("https://home.sensibo.com/api/v2/users/me/pods?apiKey=" + apiKey + "&fields=%2A")
+// httpClient is used for all outbound requests. Its timeout covers the whole
+// request, including reading the response body.
+var httpClient = &http.Client{
+	Timeout:   defaultHTTPTimeout,
+	Transport: userAgentTransport{httpTransport},
+}
+
+// httpTransport is the transport of httpClient. It honors the HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables, unless setProxy overrides
+// them.
+var httpTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	return t
+}()
+
+// setProxy sends all requests of httpClient through the proxy at rawURL.
+func setProxy(rawURL string) error {
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		return nil, fmt.Errorf("request error: %w", err)
+		return err
+	}
+	httpTransport.Proxy = http.ProxyURL(u)
+	return nil
+}
+
+// setTLSConfig makes httpClient trust the certificates in the PEM file
+// caFile, if not empty, in addition to the system ones, or skip the
+// verification of certificates altogether if insecure.
+func setTLSConfig(caFile string, insecure bool) error {
+	c := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read ca_cert_file: %w", err)
+		}
+		if c.RootCAs, err = x509.SystemCertPool(); err != nil {
+			slog.Warn("failed to load the system certificates, trusting CA_CERT_FILE only", "err", err)
+			c.RootCAs = x509.NewCertPool()
+		}
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return fmt.Errorf("invalid ca_cert_file %s: no PEM certificates found", caFile)
+		}
+	}
+	httpTransport.TLSClientConfig = c
+	return nil
+}
+
+// userAgentTransport sets the User-Agent of requests that don't have one.
+type userAgentTransport struct {
+	base http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", userAgent())
+	}
+	return t.base.RoundTrip(req)
+}
+
+// wrapHTTPError annotates err with the endpoint name, calling out client
+// timeouts and cancellation (on shutdown) explicitly.
+func wrapHTTPError(endpoint string, err error) error {
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("%s request canceled: %w", endpoint, err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("request failed code=%d error=%s", resp.StatusCode, string(body))
+	if isTimeout(err) {
+		return fmt.Errorf("%s request timed out after %v: %w", endpoint, httpClient.Timeout, err)
 	}
-	var out GetDevicesResponse
-	err = json.NewDecoder(resp.Body).Decode(&out)
-	return out.Result, err
+	return fmt.Errorf("%s request error: %w", endpoint, err)
 }
 
-type GetDevicesResponse struct {
-	Result []DeviceInfo `json:"result"`
-	Status string       `json:"status"`
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
-type DeviceInfo struct {
-	ID      string `json:"id"`
-	ACState struct {
-		On bool `json:"on"`
-	} `json:"acState"`
-	Room struct {
-		Name string `json:"name"`
-	} `json:"room"`
-	Measurements struct {
-		Temperature float64 `json:"temperature"`
-	} `json:"measurements"`
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
 }
 
-// write a function to keep only the alpanumeric characters of a string
+// sanitizeFallback is used when a string has no characters left after
+// sanitization, so that tag values are never blank. If sanitizeHash is set, a
+// hash of the original string is appended so that distinct strings (such as
+// names made only of emoji) don't collide.
+var (
+	sanitizeFallback = defaultSanitizeFallback
+	sanitizeHash     bool
+)
+
+const defaultSanitizeFallback = "unknown"
+
+// sanitizeString turns str into a tag value: Stackdriver and OpenCensus only
+// accept printable ASCII. Accents are folded into their base letter ("Büro"
+// becomes "Buro") and other non-ASCII letters and digits are written as their
+// code point ("客厅" becomes "u5ba2u5385") so that names stay distinct.
+// Runs of whitespace, hyphens and underscores become a single underscore,
+// leading/trailing separators are trimmed, and anything else is dropped.
 func sanitizeString(str string) string {
-	var result string
-	for _, char := range str {
-		if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') {
-			result += string(char)
-		} else if char == ' ' {
-			result += "_"
+	var b strings.Builder
+	sep := false
+	for _, char := range norm.NFD.String(str) {
+		switch {
+		case unicode.IsLetter(char) || unicode.IsDigit(char):
+			if sep && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			sep = false
+			if char < utf8.RuneSelf {
+				b.WriteRune(char)
+			} else {
+				fmt.Fprintf(&b, "u%04x", char)
+			}
+		case unicode.IsSpace(char) || char == '-' || char == '_':
+			sep = true
+		}
+	}
+	if b.Len() == 0 {
+		if sanitizeHash && str != "" {
+			h := fnv.New32a()
+			h.Write([]byte(str))
+			return fmt.Sprintf("%s_%08x", sanitizeFallback, h.Sum32())
 		}
+		return sanitizeFallback
 	}
-	return result
+	return b.String()
 }
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+// setVar sets *p to v for the duration of the test.
+func setVar[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// registerTestViews registers the views, in Celsius and without a metric
+// prefix, for the duration of the test.
+func registerTestViews(t *testing.T) {
+	t.Helper()
+	if err := registerViews(celsius, true, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { view.Unregister(views...) })
+}
+
+// deviceRow returns the row of the view named name for device id, or nil.
+func deviceRow(t *testing.T, name, id string) *view.Row {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rows {
+		for _, tg := range r.Tags {
+			if tg.Key == deviceIDKey && tg.Value == id {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// lastValue returns the value of a LastValue row.
+func lastValue(r *view.Row) float64 {
+	return r.Data.(*view.LastValueData).Value
+}
+
+func TestSanitizeString(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"ascii", "Bedroom", "Bedroom"},
+		{"accented latin", "Büro", "Buro"},
+		{"accented latin precomposed and combining", "Café Crème", "Cafe_Creme"},
+		{"cjk", "客厅", "u5ba2u5385"},
+		{"cjk and ascii", "主卧 2", "u4e3bu5367_2"},
+		{"emoji dropped", "Living 🛋️ Room", "Living_Room"},
+		{"only emoji", "🛋️🎮", "unknown"},
+		{"leading and trailing whitespace", "  Kids' Room  ", "Kids_Room"},
+		{"multiple spaces", "Living  Room", "Living_Room"},
+		{"mixed separators", "Living - Room", "Living_Room"},
+		{"mixed punctuation", "Mom & Dad's (Master) Room!", "Mom_Dads_Master_Room"},
+		{"leading and trailing separators", "_-Office-_", "Office"},
+		{"empty", "", "unknown"},
+		{"all punctuation", "!?.,'()", "unknown"},
+		{"whitespace only", " \t\n ", "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeString(tt.in); got != tt.want {
+				t.Errorf("sanitizeString(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeStringFallback(t *testing.T) {
+	setVar(t, &sanitizeFallback, "none")
+	setVar(t, &sanitizeHash, true)
+
+	sofa, game := sanitizeString("🛋️"), sanitizeString("🎮")
+	if !regexp.MustCompile(`^none_[0-9a-f]{8}$`).MatchString(sofa) {
+		t.Errorf("sanitizeString(sofa emoji) = %q, want none_<8 hex digits>", sofa)
+	}
+	if sofa == game {
+		t.Errorf("distinct names both sanitized to %q", sofa)
+	}
+	if again := sanitizeString("🛋️"); again != sofa {
+		t.Errorf("sanitizeString is not deterministic: %q then %q", sofa, again)
+	}
+	if got := sanitizeString(""); got != "none" {
+		t.Errorf("sanitizeString(\"\") = %q, want the unhashed fallback", got)
+	}
+	if got := sanitizeString("Office"); got != "Office" {
+		t.Errorf("sanitizeString(\"Office\") = %q, want it unchanged", got)
+	}
+}
+
+func TestRecordDeviceOffline(t *testing.T) {
+	registerTestViews(t)
+	alive, dead := true, false
+	var online, offline DeviceInfo
+	online.ID, online.ConnectionStatus.IsAlive, online.Measurements.Temperature = "on1", &alive, 21
+	offline.ID, offline.ConnectionStatus.IsAlive, offline.Measurements.Temperature = "off1", &dead, 25
+	ctx := context.Background()
+	for _, d := range []DeviceInfo{online, offline} {
+		if err := recordDevice(ctx, newDeviceReading(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if r := deviceRow(t, "ac_online", "on1"); r == nil || lastValue(r) != 1 {
+		t.Errorf("ac_online of the online device = %v, want 1", r)
+	}
+	if r := deviceRow(t, "ac_online", "off1"); r == nil || lastValue(r) != 0 {
+		t.Errorf("ac_online of the offline device = %v, want 0", r)
+	}
+	if r := deviceRow(t, "room_temp", "on1"); r == nil || lastValue(r) != 21 {
+		t.Errorf("room_temp of the online device = %v, want 21", r)
+	}
+	if r := deviceRow(t, "room_temp", "off1"); r != nil {
+		t.Errorf("room_temp recorded the stale reading of the offline device: %v", lastValue(r))
+	}
+}
+
+func TestRecordDeviceFromReading(t *testing.T) {
+	registerTestViews(t)
+	alive := true
+	var d DeviceInfo
+	d.ID, d.Room.Name, d.ConnectionStatus.IsAlive, d.Measurements.Temperature = "liv1", "Living Room", &alive, 21
+	r := newDeviceReading(d)
+	r.Temp, r.Room = 22.5, "Lounge" // the views must follow the reading, not the device
+	if err := recordDevice(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	row := deviceRow(t, "room_temp", "liv1")
+	if row == nil || lastValue(row) != 22.5 {
+		t.Fatalf("room_temp = %v, want 22.5 from the reading", row)
+	}
+	for _, tg := range row.Tags {
+		if tg.Key == roomKey && tg.Value != "Lounge" {
+			t.Errorf("room = %q, want Lounge from the reading", tg.Value)
+		}
+	}
+}
+
+// runWithFakes runs a single collection with the jsonlines exporter against
+// a fake Sensibo API serving testdata/sensibo_pods.json and fake weather
+// providers, all failing if weatherDown, and returns the emitted results.
+// Other settings can be given with t.Setenv beforehand.
+func runWithFakes(t *testing.T, weatherDown bool) []CollectionResult {
+	t.Helper()
+	pods, err := os.ReadFile("testdata/sensibo_pods.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeSensibo(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/users/me/pods" || r.URL.Query().Get("apiKey") != "test-key" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(pods)
+	})
+	weather := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if weatherDown || r.URL.Path != "/forecast" {
+			w.Header().Set("Retry-After", "0") // don't wait for the backoff
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"utc_offset_seconds":0,"hourly":{"time":[%s],"temperature_2m":[10,11.5,13],"relativehumidity_2m":[80,75,70]}}`,
+			openMeteoHours(time.Now(), time.UTC))
+	}))
+	t.Cleanup(weather.Close)
+	setVar(t, &weatherBaseURL, weather.URL)
+	setVar(t, &metNoBaseURL, weather.URL)
+	var out bytes.Buffer
+	setVar[io.Writer](t, &stdout, &out)
+	t.Setenv("SENSIBO_API_KEY", "test-key")
+	t.Setenv("SINKS", "jsonlines")
+	t.Setenv("WEATHER_LOCATIONS", "home:47.68,-122.38")
+	t.Setenv("LOG_LEVEL", "error")
+
+	if err := run(context.Background(), []string{"-once"}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var results []CollectionResult
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var r CollectionResult
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("invalid jsonlines output %q: %v", out.String(), err)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// fixtureReadings are the readings of testdata/sensibo_pods.json.
+func fixtureReadings() []DeviceReading {
+	f := func(v float64) *float64 { return &v }
+	return []DeviceReading{
+		{Account: "0", Room: "Living_Room", DeviceID: "liv1", Online: true, Temp: 24.5, Humidity: f(45), ACOn: true, Mode: "cool", TargetTemp: f(22)},
+		{Account: "0", Room: "Kids_Bedroom", DeviceID: "bed1", Online: true, Temp: 20.25, Mode: "heat"}, // no humidity
+		{Account: "0", Room: "Garage", DeviceID: "gar1", Online: false, Temp: 31, Humidity: f(60), Mode: "fan"},
+	}
+}
+
+func TestRun(t *testing.T) {
+	results := runWithFakes(t, false)
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	r := results[0]
+	if r.Location != "home" || r.OutsideTemp == nil || *r.OutsideTemp != 11.5 {
+		t.Errorf("outside temperature at %q = %v, want 11.5 at home", r.Location, r.OutsideTemp)
+	}
+	if time.Since(r.Time) > time.Minute {
+		t.Errorf("timestamp %v is not of this collection", r.Time)
+	}
+	if want := fixtureReadings(); !reflect.DeepEqual(r.Devices, want) {
+		t.Errorf("devices =\n%+v\nwant\n%+v", r.Devices, want)
+	}
+}
+
+func TestRunWeatherOutage(t *testing.T) {
+	results := runWithFakes(t, true)
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	r := results[0]
+	if r.OutsideTemp != nil {
+		t.Errorf("outside temperature = %v during a weather outage, want null", *r.OutsideTemp)
+	}
+	if want := fixtureReadings(); !reflect.DeepEqual(r.Devices, want) {
+		t.Errorf("devices =\n%+v\nwant\n%+v", r.Devices, want)
+	}
+}
+
+func TestSetTLSConfig(t *testing.T) {
+	setVar[*tls.Config](t, &httpTransport.TLSClientConfig, nil)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // the expected handshake failure
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	get := func() error {
+		httpTransport.CloseIdleConnections() // so that each request verifies anew
+		resp, err := httpClient.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(); err == nil {
+		t.Fatal("request to a server with a private CA succeeded without trusting it")
+	}
+	if err := setTLSConfig(caFile, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); err != nil {
+		t.Errorf("request with CA_CERT_FILE failed: %v", err)
+	}
+	if err := setTLSConfig("", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); err != nil {
+		t.Errorf("request with INSECURE_SKIP_VERIFY failed: %v", err)
+	}
+
+	notPEM := filepath.Join(t.TempDir(), "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{notPEM, filepath.Join(t.TempDir(), "missing.pem")} {
+		if err := setTLSConfig(f, false); err == nil {
+			t.Errorf("setTLSConfig(%s) succeeded, want an error", f)
+		}
+	}
+}
+
+func TestRunTwice(t *testing.T) {
+	t.Run("first", func(t *testing.T) {
+		t.Setenv("TEMP_UNIT", "F")
+		t.Setenv("INCLUDE_ROOMS", "Garage")
+		t.Setenv("SENSIBO_MAX_RETRIES", "1")
+		t.Setenv("WEATHER_TIMEZONE", "Europe/Berlin")
+		t.Setenv("SANITIZE_FALLBACK", "none")
+		t.Setenv("WEBHOOK_URL", "http://127.0.0.1:1/hook")
+		t.Setenv("SCRAPE_INTERVAL", "1h") // overridden by -once, but sets up the trackers
+		results := runWithFakes(t, false)
+		if len(results) != 1 || len(results[0].Devices) != 1 || results[0].Devices[0].Temp != 87.8 {
+			t.Fatalf("got %+v, want the garage at 87.8F", results)
+		}
+	})
+	t.Run("second", func(t *testing.T) {
+		results := runWithFakes(t, false)
+		if len(results) != 1 {
+			t.Fatalf("got %d results, want 1", len(results))
+		}
+		if want := fixtureReadings(); !reflect.DeepEqual(results[0].Devices, want) {
+			t.Errorf("devices =\n%+v\nwant the defaults of\n%+v", results[0].Devices, want)
+		}
+		if sensiboMaxAttempts != defaultMaxAttempts || weatherTimezone != defaultWeatherTimezone ||
+			sanitizeFallback != defaultSanitizeFallback || temperatureUnit != celsius {
+			t.Errorf("settings of the first run were kept: max attempts %d, timezone %q, fallback %q, unit %q",
+				sensiboMaxAttempts, weatherTimezone, sanitizeFallback, temperatureUnit)
+		}
+		if alerts != nil || acRuntime != nil || deviceLastSeen != nil {
+			t.Error("trackers of the first run were kept")
+		}
+	})
+}
+
+func TestResetStaleWeather(t *testing.T) {
+	registerTestViews(t)
+	setVar(t, &staleWeather, nil)
+	ctx := context.Background()
+	locations := []weatherLocation{{Name: "home"}, {Name: "cabin"}}
+	collect := func(weather ...fetchedWeather) []string {
+		t.Helper()
+		resetStaleWeather(locations, weather)
+		for i, l := range locations {
+			if weather[i].ok {
+				recordWeather(ctx, l, weather[i].Weather, weather[i].stale)
+			}
+		}
+		rows, err := view.RetrieveData("outside_temp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range rows {
+			var loc, stale string
+			for _, tg := range r.Tags {
+				switch tg.Key {
+				case locationKey:
+					loc = tg.Value
+				case staleKey:
+					stale = tg.Value
+				}
+			}
+			got = append(got, fmt.Sprintf("%s stale=%s %v", loc, stale, lastValue(r)))
+		}
+		slices.Sort(got)
+		return got
+	}
+
+	collect(fetchedWeather{Weather: Weather{Temperature: 10}, ok: true}, fetchedWeather{Weather: Weather{Temperature: 5}, ok: true})
+	collect(fetchedWeather{Weather: Weather{Temperature: 10}, stale: true, ok: true}, fetchedWeather{Weather: Weather{Temperature: 5}, stale: true, ok: true})
+	got := collect(fetchedWeather{Weather: Weather{Temperature: 12}, ok: true}, fetchedWeather{Weather: Weather{Temperature: 5}, stale: true, ok: true})
+	want := []string{"cabin stale=true 5", "home stale=false 12"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rows after the outage = %q, want %q", got, want)
+	}
+}
+
+func TestRunStaleMeasurements(t *testing.T) {
+	dir := t.TempDir()
+	var mu sync.Mutex
+	var alerted []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg alertMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("bad alert: %v", err)
+		}
+		mu.Lock()
+		alerted = append(alerted, msg.DeviceID)
+		mu.Unlock()
+	}))
+	t.Cleanup(hook.Close)
+	// The measurements of bed1 are from 2020.
+	t.Setenv("MAX_MEASUREMENT_AGE", "30m")
+	t.Setenv("CSV_FILE", filepath.Join(dir, "readings.csv"))
+	t.Setenv("SQLITE_PATH", filepath.Join(dir, "readings.db"))
+	t.Setenv("WEBHOOK_URL", hook.URL)
+	t.Setenv("ALERT_MAX_TEMP", "15")
+
+	results := runWithFakes(t, false)
+	want := fixtureReadings()
+	want[1].Stale = true
+	if len(results) != 1 || !reflect.DeepEqual(results[0].Devices, want) {
+		t.Fatalf("got %+v, want bed1 stale", results)
+	}
+	mu.Lock()
+	if !reflect.DeepEqual(alerted, []string{"liv1"}) {
+		t.Errorf("alerted %q, want only liv1", alerted)
+	}
+	mu.Unlock()
+	b, err := os.ReadFile(filepath.Join(dir, "readings.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := regexp.MustCompile(`,(liv1|bed1|gar1),`).FindAllString(string(b), -1); !reflect.DeepEqual(ids, []string{",liv1,"}) {
+		t.Errorf("csv devices = %q, want only liv1", ids)
+	}
+	db, err := openSQLite(context.Background(), filepath.Join(dir, "readings.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var ids string
+	if err := db.QueryRow(`SELECT group_concat(device_id) FROM readings`).Scan(&ids); err != nil {
+		t.Fatal(err)
+	}
+	if ids != "liv1" {
+		t.Errorf("sqlite devices = %q, want only liv1", ids)
+	}
+}
+
+func TestRecordDeviceStale(t *testing.T) {
+	registerTestViews(t)
+	setVar(t, &maxMeasurementAge, 30*time.Minute)
+	alive := true
+	var d DeviceInfo
+	d.ID, d.ConnectionStatus.IsAlive, d.Measurements.Temperature = "bed1", &alive, 20.25
+	d.Measurements.Time.Time = time.Now().Add(-time.Hour)
+	r := newDeviceReading(d)
+	if !r.Stale {
+		t.Fatal("reading of hour-old measurements is not stale")
+	}
+	if err := recordDevice(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	if row := deviceRow(t, "room_temp", "bed1"); row != nil {
+		t.Errorf("room_temp recorded the stale reading: %v", lastValue(row))
+	}
+	if row := deviceRow(t, "ac_state", "bed1"); row == nil {
+		t.Error("ac_state of the stale device was not recorded")
+	}
+	if row := deviceRow(t, "stale_reading_skipped_total", "bed1"); row == nil || row.Data.(*view.CountData).Value != 1 {
+		t.Errorf("stale_reading_skipped_total = %v, want 1", row)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Temperature measures are created by registerViews, as their unit depends on
+// the configured temperature unit.
+var (
+	outsideTempMetric   *stats.Float64Measure
+	outsideFeelsLike    *stats.Float64Measure
+	outsideTempForecast *stats.Float64Measure
+	roomTemp            *stats.Float64Measure
+	roomTempSmoothed    *stats.Float64Measure
+	roomFeelsLike       *stats.Float64Measure
+	roomTempDailyMin    *stats.Float64Measure
+	roomTempDailyMax    *stats.Float64Measure
+	acTargetTemp        *stats.Float64Measure
+	acTempDelta         *stats.Float64Measure
+	roomVsOutsideDelta  *stats.Float64Measure
+)
+
+var (
+	outsideHumidity = stats.Float64("outside_humidity", "Outside relative humidity in percent", "%")
+	weatherFetched  = stats.Int64("outside_temp_fetch_success", "Outside weather fetch outcome (success=1, failure=0)", "1")
+	outsidePM25     = stats.Float64("outside_pm25", "Outside PM2.5 concentration", "ug/m3")
+	outsideAQI      = stats.Float64("outside_aqi", "Outside US Air Quality Index", "1")
+	roomHumidity    = stats.Float64("room_humidity", "The room relative humidity in percent", "%")
+	acState         = stats.Int64("ac_state", "AC state (on=1, off=0)", "state")
+	acOnline        = stats.Int64("ac_online", "Device connectivity (online=1, offline=0)", "state")
+	acMode          = stats.Int64("ac_mode", "AC mode (see acMode* constants)", "mode")
+	acFanLevel      = stats.Int64("ac_fan_level", "AC fan level (see fanLevel* constants)", "level")
+	acSwing         = stats.Int64("ac_swing", "AC swing mode (see swing* constants)", "mode")
+	acClimateReact  = stats.Int64("ac_climate_react_enabled", "Sensibo Climate React state (enabled=1, disabled=0)", "state")
+	acCompressorOn  = stats.Int64("ac_compressor_on", "Estimated AC compressor state (running=1, idle=0, see compressorOn)", "state")
+	measurementAge  = stats.Float64("room_measurement_age_seconds", "Age of the room measurements reported by the device", stats.UnitSeconds)
+	acRuntimeSecs   = stats.Float64("ac_runtime_seconds", "Estimated cumulative time the AC has been on", stats.UnitSeconds)
+	acPower         = stats.Float64("ac_power_watts", "Power draw reported by the device", "W")
+	acEnergyWh      = stats.Float64("ac_energy_wh", "Estimated cumulative energy used by the AC, from its power at each collection", "Wh")
+	roomMeasurement = stats.Float64("room_measurement", "Measurement reported by the device, named by the kind tag", "1")
+	deviceRSSI      = stats.Float64("device_rssi_dbm", "Wi-Fi signal strength of the device", "dBm")
+	batteryPercent  = stats.Float64("device_battery_percent", "Battery level of battery-powered devices", "%")
+	devicesTotal    = stats.Int64("sensibo_devices_total", "Number of devices returned by Sensibo", "1")
+	deviceInfo      = stats.Int64("device_info", "Device metadata in tags (always 1)", "1")
+
+	staleReadingSkipped = stats.Int64("stale_reading_skipped_total", "Number of room readings not recorded as they were older than MAX_MEASUREMENT_AGE", "1")
+
+	deviceLastSeenAge  = stats.Float64("device_last_seen_seconds", "Time since a device that disappeared from the device list was last listed", stats.UnitSeconds)
+	devicesDisappeared = stats.Int64("device_disappeared_total", "Number of times a device disappeared from the device list", "1")
+
+	up                   = stats.Int64("home_ac_stats_up", "Heartbeat of the collector, recorded as 1 on each collection", "1")
+	startTime            = stats.Int64("home_ac_stats_start_time_seconds", "Start time of the collector in Unix seconds", stats.UnitSeconds)
+	collectionSkipped    = stats.Int64("collection_skipped_total", "Number of collections skipped as the previous one was still running", "1")
+	sensiboUnknownFields = stats.Int64("sensibo_unknown_fields_total", "Number of distinct Sensibo device fields seen that are not decoded (SENSIBO_STRICT)", "1")
+	sensiboDecodeErrors  = stats.Int64("sensibo_decode_errors_total", "Number of Sensibo devices skipped as they failed to decode", "1")
+
+	sensiboRequestDuration = stats.Float64("sensibo_request_duration_ms", "Sensibo API request latency", stats.UnitMilliseconds)
+	weatherRequestDuration = stats.Float64("weather_request_duration_ms", "Weather API request latency", stats.UnitMilliseconds)
+	cycleDuration          = stats.Float64("collection_cycle_duration_ms", "Duration of a collection cycle, from fetching to recording the readings", stats.UnitMilliseconds)
+
+	accountKey  = tag.MustNewKey("account")
+	roomKey     = tag.MustNewKey("room")
+	deviceIDKey = tag.MustNewKey("device_id")
+	modelKey    = tag.MustNewKey("model")
+	firmwareKey = tag.MustNewKey("firmware")
+	outcomeKey  = tag.MustNewKey("outcome")
+	staleKey    = tag.MustNewKey("stale")
+	locationKey = tag.MustNewKey("location")
+	horizonKey  = tag.MustNewKey("horizon")
+	kindKey     = tag.MustNewKey("kind")
+
+	// deviceTagKeys are the tags of device-scoped views.
+	deviceTagKeys = []tag.Key{accountKey, roomKey, deviceIDKey}
+)
+
+// views are all the views exported by the program, set by registerViews.
+var views []*view.View
+
+// viewPrefix is the prefix of the view names, set by registerViews.
+var viewPrefix string
+
+// viewName returns the name of the view that registerViews names after m,
+// for exporters that write points outside of the views.
+func viewName(m stats.Measure) string {
+	if slices.Contains(unprefixedMeasures, m) {
+		return m.Name()
+	}
+	return viewPrefix + m.Name()
+}
+
+// unprefixedMeasures are the measures whose views are not named with the
+// metric prefix: the self-metrics, which carry the program name already.
+var unprefixedMeasures = []stats.Measure{up, startTime}
+
+// registerViews creates the temperature measures in unit and registers all
+// views, leaving out the outside weather views unless weather is set. View
+// names are the measure names, prefixed with prefix except for
+// unprefixedMeasures.
+func registerViews(unit tempUnit, weather bool, prefix string) error {
+	viewPrefix = prefix
+	outsideTempMetric = stats.Float64("outside_temp", "Outside temperature in "+unit.name(), string(unit))
+	outsideFeelsLike = stats.Float64("outside_feels_like", "Outside apparent temperature in "+unit.name(), string(unit))
+	outsideTempForecast = stats.Float64("outside_temp_forecast", "Outside temperature forecast in "+unit.name()+", horizon hours ahead", string(unit))
+	roomTemp = stats.Float64("room_temp", "The room temperature in "+unit.name(), string(unit))
+	roomTempSmoothed = stats.Float64("room_temp_smoothed", "Exponential moving average of the room temperature in "+unit.name(), string(unit))
+	roomFeelsLike = stats.Float64("room_feels_like", "Room apparent temperature in "+unit.name()+", as computed by Sensibo", string(unit))
+	roomTempDailyMin = stats.Float64("room_temp_daily_min", "Lowest room temperature in "+unit.name()+" since local midnight", string(unit))
+	roomTempDailyMax = stats.Float64("room_temp_daily_max", "Highest room temperature in "+unit.name()+" since local midnight", string(unit))
+	acTargetTemp = stats.Float64("ac_target_temp", "AC target temperature in "+unit.name(), string(unit))
+	acTempDelta = stats.Float64("ac_temp_delta", "Room minus AC target temperature in "+unit.name()+", while the AC is on", string(unit))
+	roomVsOutsideDelta = stats.Float64("room_vs_outside_delta", "Room minus outside temperature in "+unit.name()+" (derived from room_temp and outside_temp)", string(unit))
+
+	views = []*view.View{
+		{
+			Measure:     outsideTempMetric,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{locationKey, staleKey}},
+		{
+			Measure:     outsideHumidity,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{locationKey, staleKey}},
+		{
+			Measure:     outsideFeelsLike,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{locationKey, staleKey}},
+		{
+			Measure:     outsideTempForecast,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{locationKey, staleKey, horizonKey}},
+		{
+			Measure:     weatherFetched,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{locationKey}},
+		{
+			Measure:     outsidePM25,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{locationKey}},
+		{
+			Measure:     outsideAQI,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{locationKey}},
+		{
+			Measure:     roomTemp,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     roomTempSmoothed,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     roomTempDailyMin,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     roomTempDailyMax,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     roomFeelsLike,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Name:        "room_temp_distribution",
+			Description: "Distribution of room temperatures in " + unit.name(),
+			Measure:     roomTemp,
+			Aggregation: roomTempDistribution(unit),
+			TagKeys:     []tag.Key{roomKey}},
+		{
+			Measure:     roomHumidity,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     acState,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     acOnline,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     acMode,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     acFanLevel,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     measurementAge,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     acTempDelta,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     roomVsOutsideDelta,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{accountKey, roomKey, deviceIDKey, locationKey}},
+		{
+			Measure:     acRuntimeSecs,
+			Aggregation: view.Sum(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     acPower,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     acEnergyWh,
+			Aggregation: view.Sum(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     acSwing,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     acClimateReact,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     acCompressorOn,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     acTargetTemp,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     deviceInfo,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{deviceIDKey, modelKey, firmwareKey}},
+		{
+			Measure:     deviceRSSI,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     roomMeasurement,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{accountKey, roomKey, deviceIDKey, kindKey}},
+		{
+			Measure:     staleReadingSkipped,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{deviceIDKey}},
+		{
+			Measure:     deviceLastSeenAge,
+			Aggregation: view.LastValue(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     devicesDisappeared,
+			Aggregation: view.Count(),
+			TagKeys:     deviceTagKeys},
+		{
+			Measure:     batteryPercent,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{deviceIDKey}},
+		{
+			Measure:     devicesTotal,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{accountKey}},
+		{
+			Measure:     sensiboDecodeErrors,
+			Aggregation: view.Count()},
+		{
+			Measure:     sensiboUnknownFields,
+			Aggregation: view.Count()},
+		{
+			Measure:     up,
+			Aggregation: view.LastValue()},
+		{
+			Measure:     startTime,
+			Aggregation: view.LastValue()},
+		{
+			Measure:     collectionSkipped,
+			Aggregation: view.Count()},
+		{
+			Measure:     sensiboRequestDuration,
+			Aggregation: latencyDistribution,
+			TagKeys:     []tag.Key{outcomeKey}},
+		{
+			Measure:     weatherRequestDuration,
+			Aggregation: latencyDistribution,
+			TagKeys:     []tag.Key{outcomeKey}},
+		{
+			Measure:     cycleDuration,
+			Aggregation: cycleDistribution,
+			TagKeys:     []tag.Key{outcomeKey}},
+	}
+	if !weather {
+		views = slices.DeleteFunc(views, func(v *view.View) bool {
+			return v.Measure == outsideTempMetric || v.Measure == outsideHumidity || v.Measure == outsideFeelsLike ||
+				v.Measure == outsideTempForecast ||
+				v.Measure == roomVsOutsideDelta
+		})
+	}
+	if dualUnits {
+		views = append(views, otherUnitViews(unit, views)...)
+	} else {
+		otherUnitMeasures = nil
+	}
+	for _, v := range views {
+		if v.Name == "" {
+			v.Name = v.Measure.Name()
+		}
+		if !slices.Contains(unprefixedMeasures, v.Measure) {
+			v.Name = prefix + v.Name
+		}
+	}
+	return view.Register(views...)
+}
+
+// dualUnits enables recording every temperature measure in the other unit
+// too, named with an _f or _c suffix.
+var dualUnits bool
+
+// otherUnitMeasures are the counterparts of the temperature measures in the
+// other unit, set by registerViews if dualUnits.
+var otherUnitMeasures map[stats.Measure]otherUnitMeasure
+
+type otherUnitMeasure struct {
+	measure *stats.Float64Measure
+	from    tempUnit
+	delta   bool // a temperature difference, converted without the offset
+}
+
+// otherUnitViews creates the counterparts in the other unit of the temperature
+// measures, which are recorded in unit, and returns the counterparts of their
+// views among views.
+func otherUnitViews(unit tempUnit, views []*view.View) []*view.View {
+	other := unit.other()
+	suffix := "_" + strings.ToLower(string(other))
+	otherUnitMeasures = make(map[stats.Measure]otherUnitMeasure)
+	var out []*view.View
+	for _, t := range []struct {
+		m     *stats.Float64Measure
+		delta bool
+	}{
+		{outsideTempMetric, false},
+		{outsideFeelsLike, false},
+		{outsideTempForecast, false},
+		{roomTemp, false},
+		{roomTempSmoothed, false},
+		{roomFeelsLike, false},
+		{roomTempDailyMin, false},
+		{roomTempDailyMax, false},
+		{acTargetTemp, false},
+		{acTempDelta, true},
+		{roomVsOutsideDelta, true},
+	} {
+		o := stats.Float64(t.m.Name()+suffix, strings.ReplaceAll(t.m.Description(), unit.name(), other.name()), string(other))
+		otherUnitMeasures[t.m] = otherUnitMeasure{measure: o, from: unit, delta: t.delta}
+		for _, v := range views {
+			if v.Measure != t.m {
+				continue
+			}
+			ov := *v
+			ov.Measure = o
+			if v.Name != "" {
+				ov.Name = v.Name + suffix
+			}
+			ov.Description = strings.ReplaceAll(v.Description, unit.name(), other.name())
+			if v.Aggregation.Type == view.AggTypeDistribution {
+				ov.Aggregation = roomTempDistribution(other)
+			}
+			out = append(out, &ov)
+		}
+	}
+	return out
+}
+
+// withOtherUnit appends the temperatures among ms, converted to the other
+// unit, if dualUnits. All temperature measurements are recorded through it,
+// so that both units are always consistent.
+func withOtherUnit(ms []stats.Measurement) []stats.Measurement {
+	for _, m := range ms {
+		o, ok := otherUnitMeasures[m.Measure()]
+		if !ok {
+			continue
+		}
+		to := o.from.other()
+		v := to.from(o.from, m.Value())
+		if o.delta {
+			v = to.fromDelta(o.from, m.Value())
+		}
+		ms = append(ms, o.measure.M(v))
+	}
+	return ms
+}
+
+// metricPrefixExporters are the exporters that METRIC_PREFIX applies to.
+// Stackdriver names metrics under its own custom.googleapis.com/opencensus/
+// prefix.
+var metricPrefixExporters = []string{"prometheus", "pushgateway", "textfile", "otlp"}
+
+// validMetricPrefix matches the prefixes that keep view names valid Prometheus
+// metric names.
+var validMetricPrefix = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)?$`)
+
+// stackdriverMetricTypePrefix is the prefix of the metric types the
+// stackdriver exporter writes view data to.
+const stackdriverMetricTypePrefix = "custom.googleapis.com/opencensus/"
+
+// validStackdriverMetricName matches the view names that Stackdriver accepts in
+// custom metric types. Names it rejects fail to create their series without
+// an error being reported.
+var validStackdriverMetricName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
+// validateStackdriverNames checks that the names of views are valid in
+// Stackdriver custom metric types of at most 200 characters.
+func validateStackdriverNames(views []*view.View) error {
+	var errs []error
+	for _, v := range views {
+		if !validStackdriverMetricName.MatchString(v.Name) {
+			errs = append(errs, fmt.Errorf("invalid stackdriver metric name %q: must start with an ASCII letter and only contain ASCII letters, digits and underscores", v.Name))
+		} else if n := len(stackdriverMetricTypePrefix + v.Name); n > 200 {
+			errs = append(errs, fmt.Errorf("invalid stackdriver metric name %q: metric type is %d characters long, at most 200 are allowed", v.Name, n))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// logViewData logs the current data of all views, in place of exporting it.
+func logViewData() {
+	for _, v := range views {
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			slog.Warn("failed to read view", "view", v.Name, "err", err)
+			continue
+		}
+		for _, row := range rows {
+			args := []any{"view", v.Name, "value", formatAggregationData(row.Data)}
+			for _, t := range row.Tags {
+				args = append(args, t.Key.Name(), t.Value)
+			}
+			slog.Info("dry-run", args...)
+		}
+	}
+}
+
+func formatAggregationData(data view.AggregationData) string {
+	switch d := data.(type) {
+	case *view.LastValueData:
+		return fmt.Sprintf("%g", d.Value)
+	case *view.SumData:
+		return fmt.Sprintf("sum=%g", d.Value)
+	case *view.CountData:
+		return fmt.Sprintf("count=%d", d.Value)
+	case *view.DistributionData:
+		return fmt.Sprintf("count=%d mean=%g min=%g max=%g", d.Count, d.Mean, d.Min, d.Max)
+	default:
+		return fmt.Sprintf("%v", data)
+	}
+}
+
+// roomTempDistribution buckets room temperatures every 2°C across typical
+// indoor temperatures, converted to unit.
+func roomTempDistribution(unit tempUnit) *view.Aggregation {
+	var bounds []float64
+	for c := 14.0; c <= 32; c += 2 {
+		bounds = append(bounds, unit.fromCelsius(c))
+	}
+	return view.Distribution(bounds...)
+}
+
+// latencyDistribution is the bucketing (in ms) of request latency views.
+var latencyDistribution = view.Distribution(50, 100, 250, 500, 1000, 2500)
+
+// cycleDistribution has the buckets of cycleDuration, as a cycle spans several
+// requests and their retries.
+var cycleDistribution = view.Distribution(250, 500, 1000, 2500, 5000, 10000, 30000, 60000)
+
+// recordLatency records the time elapsed since start into m, tagged with the
+// outcome of the request or collection.
+func recordLatency(ctx context.Context, m *stats.Float64Measure, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	if err := stats.RecordWithTags(ctx,
+		[]tag.Mutator{tag.Upsert(outcomeKey, outcome)},
+		m.M(float64(time.Since(start))/float64(time.Millisecond)),
+	); err != nil {
+		slog.Warn("failed to record measurement", "measure", m.Name(), "err", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go.opencensus.io/stats/view"
+)
+
+func TestRegisterViewsPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		prefix string
+		want   map[string]bool // view name: registered
+	}{
+		{"home_ac_", map[string]bool{"home_ac_room_temp": true, "home_ac_stats_up": true, "home_ac_home_ac_stats_up": false}},
+		{"house_", map[string]bool{"house_room_temp": true, "home_ac_stats_up": true, "house_home_ac_stats_up": false,
+			"home_ac_stats_start_time_seconds": true}},
+		// Measures that happen to start with the prefix are prefixed too.
+		{"room_", map[string]bool{"room_room_temp": true, "room_temp": false}},
+		{"", map[string]bool{"room_temp": true, "home_ac_stats_up": true}},
+	} {
+		if err := registerViews(celsius, true, tt.prefix); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range tt.want {
+			if got := view.Find(name) != nil; got != want {
+				t.Errorf("prefix %q: view %s registered = %v, want %v", tt.prefix, name, got, want)
+			}
+		}
+		view.Unregister(views...)
+	}
+}
+
+func TestValidateStackdriverNames(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		valid bool
+	}{
+		{"room_temp", true},
+		{"home_ac_room_temp", true},
+		{"RoomTemp2", true},
+		{"room.temp", false},
+		{"room-temp", false},
+		{"2room_temp", false},
+		{"_room_temp", false},
+		{"room temp", false},
+		{"", false},
+		{strings.Repeat("a", 200-len(stackdriverMetricTypePrefix)), true},
+		{strings.Repeat("a", 201-len(stackdriverMetricTypePrefix)), false},
+	} {
+		err := validateStackdriverNames([]*view.View{{Name: tt.name}})
+		if (err == nil) != tt.valid {
+			t.Errorf("validateStackdriverNames(%q) = %v, want valid=%v", tt.name, err, tt.valid)
+		}
+	}
+
+	// All invalid names are reported at once.
+	err := validateStackdriverNames([]*view.View{{Name: "a.b"}, {Name: "ok"}, {Name: "1c"}})
+	if err == nil || !strings.Contains(err.Error(), `"a.b"`) || !strings.Contains(err.Error(), `"1c"`) {
+		t.Errorf("got %v, want errors for a.b and 1c", err)
+	}
+}
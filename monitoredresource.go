@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// stackdriverResourceLabels are the labels required by the monitored resource
+// types that custom metrics can be written against, by type. project_id is
+// set by Cloud Monitoring.
+var stackdriverResourceLabels = map[string][]string{
+	"global":           nil,
+	"generic_node":     {"location", "namespace", "node_id"},
+	"generic_task":     {"location", "namespace", "job", "task_id"},
+	"gce_instance":     {"instance_id", "zone"},
+	"k8s_node":         {"location", "cluster_name", "node_name"},
+	"k8s_pod":          {"location", "cluster_name", "namespace_name", "pod_name"},
+	"k8s_container":    {"location", "cluster_name", "namespace_name", "pod_name", "container_name"},
+	"aws_ec2_instance": {"instance_id", "region", "aws_account"},
+}
+
+// monitoredResource is a Stackdriver monitored resource set in the
+// configuration.
+type monitoredResource struct {
+	typ    string
+	labels map[string]string
+}
+
+func (r monitoredResource) MonitoredResource() (string, map[string]string) {
+	return r.typ, r.labels
+}
+
+// validateMonitoredResource checks that typ is one of
+// stackdriverResourceLabels and that labels has all of its labels.
+func validateMonitoredResource(typ string, labels map[string]string) error {
+	required, ok := stackdriverResourceLabels[typ]
+	if !ok {
+		var types []string
+		for t := range stackdriverResourceLabels {
+			types = append(types, t)
+		}
+		slices.Sort(types)
+		return fmt.Errorf("invalid stackdriver_resource_type %q (supported: %s)", typ, strings.Join(types, ", "))
+	}
+	var missing []string
+	for _, l := range required {
+		if labels[l] == "" {
+			missing = append(missing, l)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("invalid stackdriver_resource_labels: missing required label(s) %s of the %s resource type",
+			strings.Join(missing, ","), typ)
+	}
+	return nil
+}
+
+// parseLabels parses comma-separated "key=value" pairs, such as
+// "node_id=pi,location=us-west1".
+func parseLabels(s string) (map[string]string, error) {
+	out := make(map[string]string)
+	for i, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if k = strings.TrimSpace(k); !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q at position %d: must be key=value", pair, i)
+		}
+		out[k] = strings.TrimSpace(v)
+	}
+	return out, nil
+}
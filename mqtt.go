@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttTopicPrefix is the first level of the topics published to.
+const mqttTopicPrefix = "home-ac-stats"
+
+// mqttTimeout bounds the wait for the broker to acknowledge a message.
+const mqttTimeout = 10 * time.Second
+
+func startMQTTExporter(cfg Config) (Sink, func(), error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTTBroker).
+		SetClientID(cfg.MQTTClientID).
+		SetUsername(cfg.MQTTUsername).
+		SetPassword(cfg.MQTTPassword).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("lost connection to mqtt broker, reconnecting", "err", err)
+		})
+	c := mqtt.NewClient(opts)
+	if t := c.Connect(); !t.WaitTimeout(mqttTimeout) {
+		return nil, nil, fmt.Errorf("timed out connecting to mqtt broker %s", cfg.MQTTBroker)
+	} else if err := t.Error(); err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to mqtt broker %s: %w", cfg.MQTTBroker, err)
+	}
+	return sinkFunc(func(_ context.Context, r CollectionResult) error {
+			return publishMQTT(c, r)
+		}), func() {
+			c.Disconnect(uint(mqttTimeout / time.Millisecond))
+		}, nil
+}
+
+// publishMQTT publishes the readings of a collection cycle as retained
+// messages, so that subscribers get the last value when they connect:
+// <prefix>/<room>/temp, <prefix>/<room>/ac_on ("ON" or "OFF") and
+// <prefix>/outside/temp. Offline devices are skipped.
+func publishMQTT(c mqtt.Client, r CollectionResult) error {
+	var tokens []mqtt.Token
+	publish := func(topic, payload string) {
+		tokens = append(tokens, c.Publish(mqttTopicPrefix+"/"+topic, 1, true, payload))
+	}
+	if r.OutsideTemp != nil {
+		publish("outside/temp", formatFloat(*r.OutsideTemp))
+	}
+	for _, d := range r.Devices {
+		if !d.Online {
+			continue
+		}
+		if !d.Stale {
+			publish(d.Room+"/temp", formatFloat(d.Temp))
+		}
+		acOn := "OFF"
+		if d.ACOn {
+			acOn = "ON"
+		}
+		publish(d.Room+"/ac_on", acOn)
+	}
+	var errs []error
+	for _, t := range tokens {
+		if !t.WaitTimeout(mqttTimeout) {
+			errs = append(errs, errors.New("timed out publishing to mqtt broker"))
+		} else if err := t.Error(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
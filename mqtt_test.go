@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeMQTT records the messages published to it, which all succeed.
+type fakeMQTT struct {
+	mqtt.Client // not implemented
+	published   []string
+}
+
+func (c *fakeMQTT) Publish(topic string, _ byte, _ bool, payload any) mqtt.Token {
+	c.published = append(c.published, topic+"="+payload.(string))
+	return doneToken{}
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{}          { c := make(chan struct{}); close(c); return c }
+func (doneToken) Error() error                   { return nil }
+
+func TestPublishMQTT(t *testing.T) {
+	outside := 11.5
+	devices := fixtureReadings()
+	devices[1].Stale = true
+	var c fakeMQTT
+	if err := publishMQTT(&c, CollectionResult{OutsideTemp: &outside, Devices: devices}); err != nil {
+		t.Fatal(err)
+	}
+	// The offline garage is left out, and so is the stale temperature of the
+	// bedroom.
+	want := []string{
+		"home-ac-stats/outside/temp=11.5",
+		"home-ac-stats/Living_Room/temp=24.5",
+		"home-ac-stats/Living_Room/ac_on=ON",
+		"home-ac-stats/Kids_Bedroom/ac_on=OFF",
+	}
+	if !reflect.DeepEqual(c.published, want) {
+		t.Errorf("published %q, want %q", c.published, want)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/bridge/opencensus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// startOTLPExporter pushes the OpenCensus views to an OTLP/HTTP endpoint
+// through the OpenTelemetry bridge, every interval and on stop.
+func startOTLPExporter(endpoint string, insecure bool, interval time.Duration) (func(), error) {
+	opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlpmetrichttp.WithInsecure())
+	}
+	exporter, err := otlpmetrichttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create otlp exporter: %w", err)
+	}
+	var readerOpts []sdkmetric.PeriodicReaderOption
+	if interval > 0 {
+		readerOpts = append(readerOpts, sdkmetric.WithInterval(interval))
+	}
+	reader := sdkmetric.NewPeriodicReader(exporter, readerOpts...)
+	reader.RegisterProducer(opencensus.NewMetricProducer())
+	provider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(resource.NewSchemaless(attribute.String("service.name", "home-ac-stats"))),
+	)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil { // exports the final readings
+			slog.Error("otlp exporter error", "err", err)
+		}
+	}, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+)
+
+func startPubSubExporter(projectID, topic string) (Sink, func(), error) {
+	client, err := pubsub.NewClient(context.Background(), projectID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create pubsub client: %w", err)
+	}
+	t := client.Topic(topic)
+	return sinkFunc(func(ctx context.Context, r CollectionResult) error {
+			return publishCycle(ctx, t, r)
+		}), func() {
+			t.Stop() // flushes pending messages
+			client.Close()
+		}, nil
+}
+
+// publishCycle publishes the readings of a collection cycle as a single JSON
+// message and waits for it to be accepted.
+func publishCycle(ctx context.Context, t *pubsub.Topic, r CollectionResult) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := t.Publish(ctx, &pubsub.Message{Data: b}).Get(ctx); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", t, err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import "time"
+
+// CollectionResult holds the readings of a collection cycle, as handed to the
+// sinks. It is also the schema of the lines written by the jsonlines exporter
+// and of the messages of the pubsub exporter: fields must not be renamed or
+// removed.
+type CollectionResult struct {
+	Time        time.Time       `json:"timestamp"`
+	Location    string          `json:"location,omitempty"` // name of the weather location of OutsideTemp
+	OutsideTemp *float64        `json:"outside_temp"`       // null if unavailable
+	Devices     []DeviceReading `json:"devices"`
+}
+
+// DeviceReading holds the readings of a device. Temperatures are in the
+// configured unit. The views are recorded from it, so that they agree with
+// the sinks.
+type DeviceReading struct {
+	Account    string   `json:"account"`
+	Room       string   `json:"room"` // sanitized
+	DeviceID   string   `json:"device_id"`
+	Online     bool     `json:"online"`
+	Temp       float64  `json:"temp"`
+	Humidity   *float64 `json:"humidity"` // null if not reported
+	ACOn       bool     `json:"ac_on"`
+	Mode       string   `json:"mode"`
+	TargetTemp *float64 `json:"target_temp"` // null if the AC is off
+	// Stale is set if the measurements are older than MAX_MEASUREMENT_AGE, in
+	// which case Temp and Humidity are not current and sinks leave them out.
+	Stale bool `json:"stale,omitempty"`
+
+	// device is the device the reading is of, for the views of the fields
+	// that are not in the result.
+	device DeviceInfo
+}
+
+func newDeviceReading(d DeviceInfo) DeviceReading {
+	return DeviceReading{
+		Account:    d.Account,
+		Room:       sanitizeString(d.Room.Name),
+		DeviceID:   d.ID,
+		Online:     d.Online(),
+		Temp:       d.Measurements.Temperature,
+		Humidity:   d.Measurements.Humidity,
+		ACOn:       d.ACState.On,
+		Mode:       d.ACState.Mode,
+		TargetTemp: d.ACState.TargetTemperature,
+		Stale:      d.staleMeasurements(time.Now()),
+		device:     d,
+	}
+}
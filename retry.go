@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats"
+	"golang.org/x/time/rate"
+)
+
+const (
+	maxRetryAfter    = time.Minute      // cap of the delay requested by a Retry-After header
+	maxBackoff       = 30 * time.Second // cap of the exponential backoff
+	maxRetryAttempts = 10               // upper bound of SENSIBO_MAX_RETRIES and WEATHER_MAX_RETRIES
+)
+
+// doWithRetry sends req with client and reads the response body, retrying up
+// to maxAttempts attempts in total on network errors, 429 and 5xx responses.
+// Retries wait with exponential backoff, or as long as the server asks with
+// Retry-After. Each attempt first waits for limiter, if not nil, and its
+// latency is recorded into latency, if not nil.
+//
+// The returned response has its body fully read, so that reading it cannot
+// time out; the last response is returned even if its status is retryable.
+func doWithRetry(ctx context.Context, client *http.Client, req *http.Request, maxAttempts int, limiter *rate.Limiter, latency *stats.Float64Measure) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return nil, fmt.Errorf("rate limit: %w", err)
+			}
+		}
+		start := time.Now()
+		resp, err := doAttempt(client, req.Clone(ctx))
+		if latency != nil {
+			recordLatency(ctx, latency, start, attemptError(resp, err))
+		}
+		retryable := err != nil && ctx.Err() == nil ||
+			resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500)
+		if !retryable || attempt >= maxAttempts {
+			return resp, err
+		}
+		delay := backoff(attempt)
+		if resp != nil {
+			if d, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				delay = min(d, maxRetryAfter)
+			}
+			err = fmt.Errorf("status code=%d", resp.StatusCode)
+		}
+		slog.Warn("request failed, retrying", "host", req.URL.Host, "attempt", attempt, "max_attempts", maxAttempts,
+			"delay", delay.Round(time.Millisecond), "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// newLimiter returns a limiter allowing perSecond requests per second, or nil
+// (no limit) if perSecond is zero.
+func newLimiter(perSecond float64) *rate.Limiter {
+	if perSecond == 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), 1)
+}
+
+func doAttempt(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactURL(urlErr.URL)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// secretQueryParams are the query parameters that hold credentials.
+var secretQueryParams = []string{"apiKey"}
+
+// redactURL masks the values of secretQueryParams in rawURL, so that errors
+// that include the URL of a request can be logged.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<unparseable url>"
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, p := range params {
+		if k, _, ok := strings.Cut(p, "="); ok && slices.Contains(secretQueryParams, k) {
+			params[i] = k + "=***"
+		}
+	}
+	u.RawQuery = strings.Join(params, "&")
+	return u.String()
+}
+
+// attemptError returns the outcome of an attempt for the latency metric.
+func attemptError(resp *http.Response, err error) error {
+	if err == nil && resp.StatusCode >= 400 {
+		return errors.New(resp.Status)
+	}
+	return err
+}
+
+// backoff returns the delay before the next attempt: exponential in the
+// attempt number up to maxBackoff, with up to 50% jitter.
+func backoff(attempt int) time.Duration {
+	d := maxBackoff
+	if shift := attempt - 1; shift < 30 { // larger shifts overflow
+		d = min(time.Second<<shift, maxBackoff)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// retryAfter parses a Retry-After header, given either in seconds or as an
+// HTTP date.
+func retryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWeatherRetriesTransientFailures(t *testing.T) {
+	setVar(t, &weatherMaxAttempts, 3)
+	setVar(t, &temperatureUnit, celsius)
+	setVar(t, &weatherForecastHours, 0)
+	var calls int
+	fakeOpenMeteo(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= 2 {
+			w.Header().Set("Retry-After", "0") // don't wait for the backoff
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"utc_offset_seconds":0,"hourly":{"time":[%s],"temperature_2m":[1,2,3]}}`,
+			openMeteoHours(time.Now(), time.UTC))
+	})
+
+	w, err := getOpenMeteoWeather(context.Background(), "47.68", "-122.38")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Temperature != 2 {
+		t.Errorf("temperature = %v, want 2", w.Temperature)
+	}
+	if calls != 3 {
+		t.Errorf("got %d requests, want 3", calls)
+	}
+}
+
+func TestDoWithRetryRetryAfter(t *testing.T) {
+	var times []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		times = append(times, time.Now())
+		if len(times) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+
+	resp, err := doWithRetry(context.Background(), srv.Client(), req, 2, nil, weatherRequestDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(times) != 2 {
+		t.Fatalf("got status %d after %d requests, want 200 after 2", resp.StatusCode, len(times))
+	}
+	if d := times[1].Sub(times[0]); d < time.Second {
+		t.Errorf("retried after %v, want at least the 1s of Retry-After", d)
+	}
+}
+
+func TestDoWithRetryClientError(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+
+	resp, err := doWithRetry(context.Background(), srv.Client(), req, 3, nil, weatherRequestDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest || calls != 1 {
+		t.Errorf("got status %d after %d requests, want 400 after 1", resp.StatusCode, calls)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		in     string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{"Wed, 01 May 2024 12:00:30 GMT", 30 * time.Second, true},
+		{"Wed, 01 May 2024 11:59:00 GMT", 0, true}, // in the past
+		{"soon", 0, false},
+	} {
+		if got, ok := retryAfter(tt.in, now); got != tt.want || ok != tt.wantOK {
+			t.Errorf("retryAfter(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestBackoffCapped(t *testing.T) {
+	for attempt := 1; attempt <= 100; attempt++ {
+		if d := backoff(attempt); d <= 0 || d > maxBackoff {
+			t.Fatalf("backoff(%d) = %v, want in (0, %v]", attempt, d, maxBackoff)
+		}
+	}
+	if d := backoff(1); d < 500*time.Millisecond || d > time.Second {
+		t.Errorf("backoff(1) = %v, want between 500ms and 1s", d)
+	}
+}
+
+func TestLimiterThrottlesBursts(t *testing.T) {
+	if l := newLimiter(0); l != nil {
+		t.Errorf("newLimiter(0) = %v, want nil (unlimited)", l)
+	}
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls++ }))
+	defer srv.Close()
+	limiter := newLimiter(20) // one request every 50ms
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := doWithRetry(context.Background(), srv.Client(), req, 1, limiter, weatherRequestDuration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 180*time.Millisecond {
+		t.Errorf("5 requests at 20/s took %v, want at least 200ms", d)
+	}
+
+	// A request that can't get a token before the context ends fails rather
+	// than being sent.
+	slow := newLimiter(0.1)
+	calls = 0
+	if _, err := doWithRetry(context.Background(), srv.Client(), req, 1, slow, weatherRequestDuration); err != nil {
+		t.Fatal(err) // the first token is available immediately
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := doWithRetry(ctx, srv.Client(), req, 1, slow, weatherRequestDuration); err == nil {
+		t.Error("request beyond the rate succeeded before its context ended")
+	}
+	if calls != 1 {
+		t.Errorf("got %d requests, want 1", calls)
+	}
+}
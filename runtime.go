@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// acRuntime accumulates how long each AC has been on, or is nil if runtime
+// tracking is disabled (outside of daemon mode).
+var acRuntime *runtimeTracker
+
+// runtimeTracker estimates the on-time of devices from their state at each
+// collection: a device that was on at the previous collection is assumed to
+// have run until the current one.
+type runtimeTracker struct {
+	maxGap time.Duration // longer gaps between collections are not counted
+
+	mu       sync.Mutex
+	devices  map[string]*deviceRuntime // by device ID
+	recorded map[string]bool           // devices recorded since startup
+}
+
+type deviceRuntime struct {
+	On       bool      `json:"on"`
+	LastSeen time.Time `json:"last_seen"`
+	Total    float64   `json:"total_seconds"`
+}
+
+func newRuntimeTracker(maxGap time.Duration) *runtimeTracker {
+	return &runtimeTracker{
+		maxGap:   maxGap,
+		devices:  make(map[string]*deviceRuntime),
+		recorded: make(map[string]bool),
+	}
+}
+
+// update records that device id is in the given state at now, and returns the
+// seconds to add to its cumulative runtime counter. The first update of a
+// device after startup returns its total, so that a counter restored from the
+// state file continues where it left off.
+func (t *runtimeTracker) update(id string, on bool, now time.Time) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.devices[id]
+	if !ok {
+		d = &deviceRuntime{}
+		t.devices[id] = d
+	}
+	var inc float64
+	if gap := now.Sub(d.LastSeen); ok && d.On && gap > 0 && gap <= t.maxGap {
+		inc = gap.Seconds()
+	}
+	d.Total += inc
+	d.On, d.LastSeen = on, now
+	if !t.recorded[id] {
+		t.recorded[id] = true
+		return d.Total
+	}
+	return inc
+}
+
+// load restores the accumulated runtimes from path. A missing file is not an
+// error.
+func (t *runtimeTracker) load(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read runtime state: %w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := json.Unmarshal(b, &t.devices); err != nil {
+		return fmt.Errorf("failed to decode runtime state: %w", err)
+	}
+	if t.devices == nil {
+		t.devices = make(map[string]*deviceRuntime)
+	}
+	return nil
+}
+
+// save writes the accumulated runtimes to path.
+func (t *runtimeTracker) save(path string) error {
+	t.mu.Lock()
+	b, err := json.Marshal(t.devices)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, b); err != nil {
+		return fmt.Errorf("failed to write runtime state: %w", err)
+	}
+	return nil
+}
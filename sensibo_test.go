@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opencensus.io/stats/view"
+)
+
+// fakeSensibo points sensiboBaseURL at a server running handler for the
+// duration of the test.
+func fakeSensibo(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	setVar(t, &sensiboBaseURL, srv.URL)
+}
+
+// serveJSON returns a handler that responds with body.
+func serveJSON(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}
+}
+
+func TestGetDevices(t *testing.T) {
+	var gotPath, gotKey string
+	fakeSensibo(t, func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotKey = r.URL.Path, r.URL.Query().Get("apiKey")
+		serveJSON(`{"status":"success","result":[
+			{"id":"abc","acState":{"on":true,"mode":"cool","targetTemperature":22},"room":{"name":"Bedroom"},
+			 "measurements":{"temperature":23.5,"humidity":40}},
+			{"id":"def","acState":{"on":false},"room":{"name":"Office"},"measurements":{"temperature":19}}]}`)(w, r)
+	})
+
+	devices, err := GetDevices(context.Background(), "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "/users/me/pods" || gotKey != "key1" {
+		t.Errorf("request path=%q apiKey=%q, want /users/me/pods and key1", gotPath, gotKey)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want 2", len(devices))
+	}
+	d := devices[0]
+	if d.ID != "abc" || d.Room.Name != "Bedroom" || !d.ACState.On || d.ACState.Mode != "cool" {
+		t.Errorf("devices[0] = %+v", d)
+	}
+	if d.Measurements.Temperature != 23.5 {
+		t.Errorf("devices[0] temperature = %v, want 23.5", d.Measurements.Temperature)
+	}
+	if h := d.Measurements.Humidity; h == nil || *h != 40 {
+		t.Errorf("devices[0] humidity = %v, want 40", h)
+	}
+	if tt := d.ACState.TargetTemperature; tt == nil || *tt != 22 {
+		t.Errorf("devices[0] target temperature = %v, want 22", tt)
+	}
+	d = devices[1]
+	if d.ID != "def" || d.ACState.On || d.Measurements.Temperature != 19 {
+		t.Errorf("devices[1] = %+v", d)
+	}
+	if d.Measurements.Humidity != nil || d.ACState.TargetTemperature != nil {
+		t.Errorf("devices[1] has humidity %v, target temperature %v, want neither",
+			d.Measurements.Humidity, d.ACState.TargetTemperature)
+	}
+}
+
+func TestGetDevicesStatus(t *testing.T) {
+	fakeSensibo(t, serveJSON(`{"status":"failure","result":[{"id":"abc","measurements":{"temperature":20}}]}`))
+
+	devices, err := GetDevices(context.Background(), "key1")
+	if err == nil {
+		t.Fatalf("got %d devices and no error for a failure status", len(devices))
+	}
+	if !strings.Contains(err.Error(), `status="failure"`) {
+		t.Errorf("error %q does not include the status", err)
+	}
+}
+
+func TestDeviceOnline(t *testing.T) {
+	alive, dead := true, false
+	for _, tt := range []struct {
+		name    string
+		isAlive *bool
+		want    bool
+	}{
+		{"not reported", nil, true},
+		{"alive", &alive, true},
+		{"dead", &dead, false},
+	} {
+		var d DeviceInfo
+		d.ConnectionStatus.IsAlive = tt.isAlive
+		if got := d.Online(); got != tt.want {
+			t.Errorf("%s: Online() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBatteryLevel(t *testing.T) {
+	registerTestViews(t)
+	fakeSensibo(t, serveJSON(`{"status":"success","result":[
+		{"id":"sensor","room":{"name":"Nursery"},"measurements":{"temperature":21,"battery":87}},
+		{"id":"mains","room":{"name":"Office"},"measurements":{"temperature":22}}]}`))
+
+	devices, err := GetDevices(context.Background(), "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("got %d devices, want 2", len(devices))
+	}
+	if b := devices[0].Measurements.Battery; b == nil || *b != 87 {
+		t.Errorf("battery of the battery-powered device = %v, want 87", b)
+	}
+	if b := devices[1].Measurements.Battery; b != nil {
+		t.Errorf("battery of the mains-powered device = %v, want nil", *b)
+	}
+	for _, d := range devices {
+		if err := recordDevice(context.Background(), newDeviceReading(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r := deviceRow(t, "device_battery_percent", "sensor"); r == nil || lastValue(r) != 87 {
+		t.Errorf("device_battery_percent of the battery-powered device = %v, want 87", r)
+	}
+	if r := deviceRow(t, "device_battery_percent", "mains"); r != nil {
+		t.Errorf("device_battery_percent recorded %v for the mains-powered device", lastValue(r))
+	}
+}
+
+func TestGetDevicesSkipsBrokenDevice(t *testing.T) {
+	registerTestViews(t)
+	fakeSensibo(t, serveJSON(`{"status":"success","result":[
+		{"id":"good1","measurements":{"temperature":21}},
+		{"id":"broken","measurements":{"temperature":"warm"}},
+		{"id":"good2","measurements":{"temperature":22}}]}`))
+
+	devices, err := GetDevices(context.Background(), "key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, d := range devices {
+		ids = append(ids, d.ID)
+	}
+	if strings.Join(ids, ",") != "good1,good2" {
+		t.Errorf("got devices %v, want good1 and good2", ids)
+	}
+	rows, err := view.RetrieveData("sensibo_decode_errors_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Data.(*view.CountData).Value != 1 {
+		t.Errorf("sensibo_decode_errors_total rows = %v, want a count of 1", rows)
+	}
+}
+
+func TestGetDevicesAllBroken(t *testing.T) {
+	fakeSensibo(t, serveJSON(`{"status":"success","result":[{"id":1},{"id":2}]}`))
+
+	if devices, err := GetDevices(context.Background(), "key1"); err == nil {
+		t.Errorf("got %d devices and no error when none decode", len(devices))
+	}
+}
+
+// captureLogs sends the logs to the returned buffer for the duration of the
+// test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+func TestGetDevicesRejectedKey(t *testing.T) {
+	setVar(t, &sensiboMaxAttempts, 3)
+	const key = "s3cr3t+key/1"
+	for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		logs := captureLogs(t)
+		var calls int
+		fakeSensibo(t, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			http.Error(w, "bad apiKey "+r.URL.Query().Get("apiKey"), code)
+		})
+
+		_, err := GetDevices(context.Background(), key)
+		if err == nil {
+			t.Fatalf("code %d: GetDevices succeeded", code)
+		}
+		if !strings.Contains(err.Error(), "sensibo API key invalid or expired; check SENSIBO_API_KEY") {
+			t.Errorf("code %d: error %q is not the rejected key message", code, err)
+		}
+		if calls != 1 {
+			t.Errorf("code %d: got %d requests, want 1 (not retried)", code, calls)
+		}
+		if out := err.Error() + logs.String(); strings.Contains(out, key) || strings.Contains(out, url.QueryEscape(key)) {
+			t.Errorf("code %d: the API key leaked into %q", code, out)
+		}
+	}
+}
+
+func TestGetDevicesErrorsMaskKey(t *testing.T) {
+	const key = "s3cr3t+key/1"
+	setVar(t, &sensiboMaxAttempts, 2)
+
+	t.Run("network error", func(t *testing.T) {
+		logs := captureLogs(t)
+		srv := httptest.NewServer(http.NotFoundHandler())
+		srv.Close() // fail to connect, with the URL in the error
+		setVar(t, &sensiboBaseURL, srv.URL)
+
+		_, err := GetDevices(context.Background(), key)
+		if err == nil {
+			t.Fatal("GetDevices succeeded")
+		}
+		if !strings.Contains(logs.String(), "retrying") {
+			t.Errorf("the failure was not retried, logs: %s", logs)
+		}
+		if out := err.Error() + logs.String(); strings.Contains(out, key) || strings.Contains(out, url.QueryEscape(key)) {
+			t.Errorf("the API key leaked into %q", out)
+		}
+	})
+	t.Run("error body", func(t *testing.T) {
+		fakeSensibo(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "bad request %s?%s", r.URL.Path, r.URL.RawQuery)
+		})
+
+		_, err := GetDevices(context.Background(), key)
+		if err == nil {
+			t.Fatal("GetDevices succeeded")
+		}
+		if msg := err.Error(); strings.Contains(msg, key) || strings.Contains(msg, url.QueryEscape(key)) ||
+			!strings.Contains(msg, "apiKey=***") {
+			t.Errorf("error %q is not masked", msg)
+		}
+	})
+}
+
+func TestRedactURL(t *testing.T) {
+	for in, want := range map[string]string{
+		"https://home.sensibo.com/api/v2/users/me/pods?apiKey=abc&fields=id": "https://home.sensibo.com/api/v2/users/me/pods?apiKey=***&fields=id",
+		"https://home.sensibo.com/api/v2/users/me/pods?fields=id":            "https://home.sensibo.com/api/v2/users/me/pods?fields=id",
+		"https://example.com/?apiKeyX=1&apiKey=2":                            "https://example.com/?apiKeyX=1&apiKey=***",
+		"://bad": "<unparseable url>",
+	} {
+		if got := redactURL(in); got != want {
+			t.Errorf("redactURL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNewSensiboRequest(t *testing.T) {
+	setVar(t, &sensiboBaseURL, "https://sensibo.test/api/v2")
+	params := url.Values{"fields": {"id,room"}}
+
+	t.Run("query", func(t *testing.T) {
+		setVar(t, &sensiboAPIKeyHeader, "")
+		req, err := newSensiboRequest(context.Background(), http.MethodGet, "/users/me/pods", params, "k1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Method != http.MethodGet || req.URL.Host != "sensibo.test" || req.URL.Path != "/api/v2/users/me/pods" {
+			t.Errorf("request %s %s", req.Method, req.URL)
+		}
+		if q := req.URL.Query(); q.Get("apiKey") != "k1" || q.Get("fields") != "id,room" {
+			t.Errorf("query %q, want apiKey=k1 and fields=id,room", req.URL.RawQuery)
+		}
+	})
+	t.Run("header", func(t *testing.T) {
+		setVar(t, &sensiboAPIKeyHeader, "X-Api-Key")
+		req, err := newSensiboRequest(context.Background(), http.MethodPost, "/pods/abc", params, "k1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Method != http.MethodPost {
+			t.Errorf("method %s, want POST", req.Method)
+		}
+		if got := req.Header.Get("X-Api-Key"); got != "k1" {
+			t.Errorf("X-Api-Key header = %q, want k1", got)
+		}
+		if q := req.URL.Query(); q.Has("apiKey") || q.Get("fields") != "id,room" {
+			t.Errorf("query %q, want only fields=id,room", req.URL.RawQuery)
+		}
+	})
+	if params.Has("apiKey") {
+		t.Error("newSensiboRequest modified the params")
+	}
+}
+
+func TestGetDeviceDetails(t *testing.T) {
+	setVar(t, &maxConcurrency, 2)
+	setVar(t, &sensiboMaxAttempts, 1)
+	var mu sync.Mutex
+	gotFields := map[string]string{}
+	fakeSensibo(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		gotFields[r.URL.Path] = r.URL.Query().Get("fields")
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/pods/abc":
+			serveJSON(`{"status":"success","result":{"id":"abc","measurements":{"humidity":41,"battery":80}}}`)(w, r)
+		case "/pods/def":
+			// targetTemperature decodes before the type error of on.
+			serveJSON(`{"status":"success","result":{"acState":{"targetTemperature":25,"on":"yes"}}}`)(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	logs := captureLogs(t)
+	target, humidity := 22.0, 40.0
+	devices := make([]DeviceInfo, 2)
+	devices[0].ID, devices[0].Room.Name, devices[0].Measurements.Temperature = "abc", "Bedroom", 23.5
+	devices[0].Measurements.Humidity = &humidity
+	devices[1].ID = "def"
+	devices[1].ACState.On, devices[1].ACState.TargetTemperature = true, &target
+
+	getDeviceDetails(context.Background(), "key1", devices)
+	if want := strings.Join(sensiboFields, ","); gotFields["/pods/abc"] != want || gotFields["/pods/def"] != want {
+		t.Errorf("fields = %v, want %q for both devices", gotFields, want)
+	}
+	d := devices[0]
+	if d.Room.Name != "Bedroom" || d.Measurements.Temperature != 23.5 {
+		t.Errorf("listed fields of devices[0] were not kept: %+v", d)
+	}
+	if h, b := d.Measurements.Humidity, d.Measurements.Battery; h == nil || *h != 41 || b == nil || *b != 80 {
+		t.Errorf("devices[0] humidity = %v, battery = %v, want 41 and 80 from the details", h, b)
+	}
+	if humidity != 40 {
+		t.Errorf("the listed humidity was overwritten with %v", humidity)
+	}
+	d = devices[1]
+	if tt := d.ACState.TargetTemperature; !d.ACState.On || tt == nil || *tt != 22 || target != 22 {
+		t.Errorf("devices[1] = %+v (target %v), want it as listed after a failed decode", d.ACState, target)
+	}
+	if want := "failed to get device details"; !strings.Contains(logs.String(), want) {
+		t.Errorf("logs = %q, want %q", logs, want)
+	}
+}
+
+func TestCheckUnknownFields(t *testing.T) {
+	registerTestViews(t)
+	setVar(t, &sensiboStrict, true)
+	t.Cleanup(func() {
+		unknownFieldsLogged.Range(func(k, _ any) bool { unknownFieldsLogged.Delete(k); return true })
+	})
+	// Both devices have the unknown fields, and Room is known despite its case.
+	fakeSensibo(t, serveJSON(`{"status":"success","result":[
+		{"id":"abc","newField":1,"Room":{"name":"Bedroom"},"measurements":{"temperature":23.5,"pm25":7}},
+		{"id":"def","newField":2,"room":{"name":"Office"},"measurements":{"temperature":19,"pm25":3}}]}`))
+	logs := captureLogs(t)
+
+	for i := 0; i < 2; i++ {
+		if _, err := GetDevices(context.Background(), "key1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := view.RetrieveData("sensibo_unknown_fields_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Data.(*view.CountData).Value != 2 {
+		t.Errorf("sensibo_unknown_fields_total rows = %v, want a count of 2", rows)
+	}
+	for _, field := range []string{"field=newField", "field=measurements.pm25"} {
+		if n := strings.Count(logs.String(), field); n != 1 {
+			t.Errorf("%s logged %d times, want once; logs:\n%s", field, n, logs)
+		}
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	type elem struct {
+		A int `json:"a"`
+	}
+	type doc struct {
+		Name  string `json:"name,omitempty"`
+		Skip  string `json:"-"`
+		Plain int
+		Elems []elem         `json:"elems"`
+		Ptr   *elem          `json:"ptr"`
+		Any   any            `json:"any"`
+		Map   map[string]int `json:"map"`
+	}
+	raw := `{"name":"x","Skip":"y","plain":1,"elems":[{"a":1,"b":2},{"b":3,"c":4}],"ptr":{"a":1,"d":5},
+		"any":{"e":6},"map":{"f":7},"extra":null}`
+	got := unknownFields(json.RawMessage(raw), reflect.TypeOf(doc{}), "")
+	want := []string{"Skip", "elems.b", "elems.c", "extra", "ptr.d"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
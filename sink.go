@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// Sink is a destination of the collected readings.
+type Sink interface {
+	Record(ctx context.Context, r CollectionResult) error
+}
+
+// sinkFunc adapts a function to Sink.
+type sinkFunc func(ctx context.Context, r CollectionResult) error
+
+func (f sinkFunc) Record(ctx context.Context, r CollectionResult) error { return f(ctx, r) }
+
+// criticalSinks fail the collection when they fail, e.g. so that cron runs
+// report a failed push in their exit code. Failures of other sinks are only
+// logged.
+var criticalSinks = []string{"jsonlines", "pushgateway"}
+
+// namedSink is a configured sink.
+type namedSink struct {
+	name string
+	Sink // nil for exporters that export the views in the background
+}
+
+// startSinks starts the sinks named in cfg, plus the CSV and SQLite sinks if
+// their paths are set, and returns a function that flushes and stops them.
+func startSinks(ctx context.Context, cfg Config) (sinks []namedSink, stop func(), err error) {
+	var stops []func()
+	stop = func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+	defer func() {
+		if err != nil {
+			stop()
+		}
+	}()
+	for _, name := range cfg.sinkNames() {
+		s, stopSink, err := startSink(name, cfg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to start %s sink: %w", name, err)
+		}
+		sinks = append(sinks, namedSink{name: name, Sink: s})
+		stops = append(stops, stopSink)
+	}
+	if cfg.CSVFile != "" {
+		if csvOut, err = openCSV(cfg.CSVFile); err != nil {
+			return nil, nil, err
+		}
+		sinks = append(sinks, namedSink{name: "csv", Sink: csvOut})
+		stops = append(stops, func() { csvOut.close() })
+	}
+	if cfg.SQLitePath != "" {
+		db, err := openSQLite(ctx, cfg.SQLitePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		sinks = append(sinks, namedSink{name: "sqlite", Sink: sinkFunc(func(ctx context.Context, r CollectionResult) error {
+			return insertReadings(ctx, db, r)
+		})})
+		stops = append(stops, func() { db.Close() })
+	}
+	return sinks, stop, nil
+}
+
+// recordSinks hands r to every sink, even if some of them fail, and returns
+// the errors of criticalSinks.
+func recordSinks(ctx context.Context, sinks []namedSink, r CollectionResult) error {
+	var errs []error
+	for _, s := range sinks {
+		if s.Sink == nil {
+			continue
+		}
+		if err := s.Record(ctx, r); err != nil {
+			if slices.Contains(criticalSinks, s.name) {
+				errs = append(errs, fmt.Errorf("%s sink: %w", s.name, err))
+			} else {
+				slog.Error("failed to record readings", "sink", s.name, "err", err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// sqliteSchema creates the readings table, one row per device and collection
+// cycle. ts is in Unix seconds; columns that are unavailable are NULL.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS readings (
+	ts           INTEGER NOT NULL,
+	location     TEXT,
+	outside_temp REAL,
+	device_id    TEXT NOT NULL,
+	room         TEXT NOT NULL,
+	room_temp    REAL NOT NULL,
+	ac_on        INTEGER NOT NULL,
+	target_temp  REAL
+);
+CREATE INDEX IF NOT EXISTS readings_ts ON readings (ts);
+`
+
+// openSQLite opens the database in path, creating it and its schema if needed.
+func openSQLite(ctx context.Context, path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create sqlite schema: %w", err)
+	}
+	return db, nil
+}
+
+// insertReadings stores the readings of a collection cycle in a single
+// transaction. Offline devices are left out, as they report their last known
+// readings, and so are stale readings.
+func insertReadings(ctx context.Context, db *sql.DB, r CollectionResult) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() // no-op after a successful commit
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO readings
+		(ts, location, outside_temp, device_id, room, room_temp, ac_on, target_temp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert: %w", err)
+	}
+	defer stmt.Close()
+	var loc sql.NullString
+	if r.Location != "" {
+		loc = sql.NullString{String: r.Location, Valid: true}
+	}
+	for _, d := range r.Devices {
+		if !d.Online || d.Stale {
+			continue
+		}
+		if _, err := stmt.ExecContext(ctx, r.Time.Unix(), loc, r.OutsideTemp, d.DeviceID, d.Room,
+			d.Temp, d.ACOn, d.TargetTemp); err != nil {
+			return fmt.Errorf("failed to insert reading of device %s: %w", d.DeviceID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit readings: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInsertReadings(t *testing.T) {
+	ctx := context.Background()
+	db, err := openSQLite(ctx, filepath.Join(t.TempDir(), "readings.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	outside := 11.5
+	r := CollectionResult{Time: time.Unix(1700000000, 0), Location: "home", OutsideTemp: &outside, Devices: fixtureReadings()}
+	if err := insertReadings(ctx, db, r); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT ts, location, outside_temp, device_id, room, room_temp, ac_on, target_temp
+		FROM readings ORDER BY rowid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	type row struct {
+		ts             int64
+		location       string
+		outside        float64
+		deviceID, room string
+		temp           float64
+		acOn           bool
+		target         sql.NullFloat64
+	}
+	var got []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.ts, &r.location, &r.outside, &r.deviceID, &r.room, &r.temp, &r.acOn, &r.target); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// The offline garage is left out.
+	want := []row{
+		{1700000000, "home", 11.5, "liv1", "Living_Room", 24.5, true, sql.NullFloat64{Float64: 22, Valid: true}},
+		{1700000000, "home", 11.5, "bed1", "Kids_Bedroom", 20.25, false, sql.NullFloat64{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rows =\n%+v\nwant\n%+v", got, want)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+
+	"contrib.go.opencensus.io/exporter/prometheus"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// textfileWriter writes the metrics in the Prometheus text format to a file,
+// for the textfile collector of node_exporter.
+type textfileWriter struct {
+	path string
+	reg  *prom.Registry
+}
+
+func startTextfileExporter(path string) (Sink, func(), error) {
+	reg := prom.NewRegistry()
+	if _, err := prometheus.NewExporter(prometheus.Options{
+		Registry: reg,
+		OnError: func(err error) {
+			slog.Error("textfile exporter error", "err", err)
+		},
+	}); err != nil {
+		return nil, nil, err
+	}
+	return &textfileWriter{path: path, reg: reg}, func() {}, nil
+}
+
+// Record writes the current metrics.
+func (t *textfileWriter) Record(context.Context, CollectionResult) error {
+	return t.write()
+}
+
+// write replaces the file with the current metrics, atomically so that the
+// collector never reads a partial file.
+func (t *textfileWriter) write() error {
+	families, err := t.reg.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+	var b bytes.Buffer
+	enc := expfmt.NewEncoder(&b, expfmt.FmtText)
+	for _, f := range families {
+		if err := enc.Encode(f); err != nil {
+			return fmt.Errorf("failed to encode metrics: %w", err)
+		}
+	}
+	if err := writeFileAtomic(t.path, b.Bytes()); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	return nil
+}
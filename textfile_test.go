@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+)
+
+func TestTextfileExporter(t *testing.T) {
+	registerTestViews(t)
+	path := filepath.Join(t.TempDir(), "home_ac.prom")
+	sink, stop, err := startTextfileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	stats.Record(context.Background(), up.M(1))
+	// Recording is asynchronous; reading a view waits for it.
+	if _, err := view.RetrieveData("home_ac_stats_up"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sink.Record(context.Background(), CollectionResult{}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0o644 {
+		t.Errorf("file mode = %v, want -rw-r--r-- so that node_exporter can read it", mode)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "# TYPE home_ac_stats_up gauge") {
+		t.Errorf("file does not have the heartbeat:\n%s", b)
+	}
+	if matches, _ := filepath.Glob(path + ".tmp*"); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
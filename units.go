@@ -0,0 +1,77 @@
+package main
+
+import "fmt"
+
+// tempUnit is the unit temperatures are recorded in. Its value is used as the
+// unit of the temperature measures.
+type tempUnit string
+
+const (
+	celsius    tempUnit = "C"
+	fahrenheit tempUnit = "F"
+)
+
+// temperatureUnit is the configured unit of all recorded temperatures.
+var temperatureUnit = celsius
+
+func parseTempUnit(s string) (tempUnit, error) {
+	switch tempUnit(s) {
+	case "", celsius:
+		return celsius, nil
+	case fahrenheit:
+		return fahrenheit, nil
+	default:
+		return "", fmt.Errorf("invalid temp_unit %q (supported: C, F)", s)
+	}
+}
+
+func (u tempUnit) name() string {
+	if u == fahrenheit {
+		return "Fahrenheit"
+	}
+	return "Celsius"
+}
+
+// fromCelsius converts a temperature in Celsius to u.
+func (u tempUnit) fromCelsius(c float64) float64 {
+	return u.from(celsius, c)
+}
+
+// from converts a temperature v in unit src to u. An empty src is Celsius.
+func (u tempUnit) from(src tempUnit, v float64) float64 {
+	switch {
+	case src == u, src == "" && u == celsius:
+		return v
+	case u == fahrenheit:
+		return v*9/5 + 32
+	default:
+		return (v - 32) * 5 / 9
+	}
+}
+
+// fromDelta converts a temperature difference d in unit src to u.
+func (u tempUnit) fromDelta(src tempUnit, d float64) float64 {
+	switch {
+	case src == u, src == "" && u == celsius:
+		return d
+	case u == fahrenheit:
+		return d * 9 / 5
+	default:
+		return d * 5 / 9
+	}
+}
+
+// other returns the unit that u is not.
+func (u tempUnit) other() tempUnit {
+	if u == fahrenheit {
+		return celsius
+	}
+	return fahrenheit
+}
+
+// convertPtr converts *v from src to u in place, if set.
+func (u tempUnit) convertPtr(src tempUnit, v *float64) {
+	if v != nil {
+		*v = u.from(src, *v)
+	}
+}
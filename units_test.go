@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTempUnitFrom(t *testing.T) {
+	tests := []struct {
+		to, from tempUnit
+		in, want float64
+	}{
+		{fahrenheit, celsius, 20, 68},
+		{fahrenheit, celsius, 100, 212},
+		{fahrenheit, celsius, -40, -40},
+		{fahrenheit, "", 0, 32},
+		{celsius, fahrenheit, 68, 20},
+		{celsius, fahrenheit, 32, 0},
+		{celsius, "", 21.5, 21.5},
+		{fahrenheit, fahrenheit, 70, 70},
+	}
+	for _, tt := range tests {
+		if got := tt.to.from(tt.from, tt.in); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%q.from(%q, %v) = %v, want %v", tt.to, tt.from, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTempUnitFromDelta(t *testing.T) {
+	tests := []struct {
+		to, from tempUnit
+		in, want float64
+	}{
+		{fahrenheit, celsius, 1, 1.8},
+		{fahrenheit, celsius, -5, -9},
+		{celsius, fahrenheit, 9, 5},
+		{celsius, "", 2, 2},
+		{fahrenheit, fahrenheit, 3, 3},
+	}
+	for _, tt := range tests {
+		if got := tt.to.fromDelta(tt.from, tt.in); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%q.fromDelta(%q, %v) = %v, want %v", tt.to, tt.from, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseTempUnit(t *testing.T) {
+	for in, want := range map[string]tempUnit{"": celsius, "C": celsius, "F": fahrenheit} {
+		if got, err := parseTempUnit(in); err != nil || got != want {
+			t.Errorf("parseTempUnit(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	if _, err := parseTempUnit("K"); err == nil {
+		t.Error("parseTempUnit(\"K\") succeeded, want an error")
+	}
+}
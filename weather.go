@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultWeatherLat = "47.68"
+	defaultWeatherLon = "-122.38"
+)
+
+// validateCoordinates checks that lat and lon are valid decimal degrees.
+func validateCoordinates(lat, lon string) error {
+	if v, err := strconv.ParseFloat(lat, 64); err != nil || v < -90 || v > 90 {
+		return fmt.Errorf("invalid latitude %q: must be a number between -90 and 90", lat)
+	}
+	if v, err := strconv.ParseFloat(lon, 64); err != nil || v < -180 || v > 180 {
+		return fmt.Errorf("invalid longitude %q: must be a number between -180 and 180", lon)
+	}
+	return nil
+}
+
+// weatherLocation is a place to record the outside weather of.
+type weatherLocation struct {
+	Name string `yaml:"name"` // value of the location tag
+	Lat  string `yaml:"lat"`
+	Lon  string `yaml:"lon"`
+
+	city string // WEATHER_CITY to resolve Lat and Lon from, if set
+}
+
+// parseWeatherLocations parses semicolon-separated "name:lat,lon" entries,
+// such as "home:47.68,-122.38;cabin:46.85,-121.76".
+func parseWeatherLocations(s string) ([]weatherLocation, error) {
+	var out []weatherLocation
+	for i, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, coords, ok := strings.Cut(entry, ":")
+		lat, lon, ok2 := strings.Cut(coords, ",")
+		if !ok || !ok2 || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid location %q at position %d: must be name:lat,lon", entry, i)
+		}
+		out = append(out, weatherLocation{
+			Name: name,
+			Lat:  strings.TrimSpace(lat),
+			Lon:  strings.TrimSpace(lon),
+		})
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no locations given")
+	}
+	return out, nil
+}
+
+// coordinatesName derives a location name from coordinates, such as
+// "47_68N_122_38W" for 47.68,-122.38.
+func coordinatesName(lat, lon string) string {
+	hemisphere := func(v, pos, neg string) string {
+		if strings.HasPrefix(v, "-") {
+			return strings.TrimPrefix(v, "-") + neg
+		}
+		return strings.TrimPrefix(v, "+") + pos
+	}
+	return sanitizeString(strings.ReplaceAll(hemisphere(lat, "N", "S")+"_"+hemisphere(lon, "E", "W"), ".", "_"))
+}
+
+// Base URLs of the weather providers, overridden by tests.
+var (
+	weatherBaseURL = "https://api.open-meteo.com/v1"
+	metNoBaseURL   = "https://api.met.no/weatherapi"
+)
+
+// Weather is the outside weather for the current hour. Optional fields are nil
+// if the provider did not return them.
+type Weather struct {
+	Provider            string   `json:"provider"` // name of the provider that served the data
+	Unit                tempUnit `json:"unit"`     // unit of the temperatures, Celsius if empty
+	Temperature         float64  `json:"temperature"`
+	Humidity            *float64 `json:"humidity,omitempty"`
+	ApparentTemperature *float64 `json:"apparent_temperature,omitempty"`
+	Forecast            *float64 `json:"forecast,omitempty"` // temperature weatherForecastHours ahead
+}
+
+// in returns w with its temperatures converted to unit.
+func (w Weather) in(unit tempUnit) Weather {
+	w.Temperature = unit.from(w.Unit, w.Temperature)
+	if w.ApparentTemperature != nil {
+		v := unit.from(w.Unit, *w.ApparentTemperature)
+		w.ApparentTemperature = &v
+	}
+	if w.Forecast != nil {
+		v := unit.from(w.Unit, *w.Forecast)
+		w.Forecast = &v
+	}
+	w.Unit = unit
+	return w
+}
+
+// weatherProviderFunc fetches the current weather at the given coordinates.
+type weatherProviderFunc func(ctx context.Context, lat, lon string) (Weather, error)
+
+var weatherProviders = map[string]weatherProviderFunc{
+	"open-meteo": getOpenMeteoWeather,
+	"met-no":     getMetNoWeather,
+}
+
+// weatherTimezone is the timezone open-meteo returns times in: an IANA name,
+// or "auto" for the timezone of the coordinates.
+var weatherTimezone = defaultWeatherTimezone
+
+const defaultWeatherTimezone = "auto"
+
+// weatherForecastHours is how many hours ahead the forecast temperature is
+// recorded, or 0 to only record the current weather. Only open-meteo provides
+// forecasts.
+var weatherForecastHours int
+
+// parseWeatherMode parses a weather mode, "current" or "forecast+N", into the
+// number of forecast hours.
+func parseWeatherMode(s string) (int, error) {
+	if s == "current" {
+		return 0, nil
+	}
+	if n, ok := strings.CutPrefix(s, "forecast+"); ok {
+		if h, err := strconv.Atoi(n); err == nil && h > 0 {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weather_mode %q: must be current or forecast+N, N being a number of hours", s)
+}
+
+// weatherProvider is the name of the preferred weather provider. The others
+// are tried in order if it fails.
+var weatherProvider = "open-meteo"
+
+// weatherProviderOrder returns the provider names to try, starting with
+// primary.
+func weatherProviderOrder(primary string) []string {
+	out := []string{primary}
+	for _, name := range []string{"open-meteo", "met-no"} {
+		if name != primary {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// getWeather fetches the current weather from the preferred provider, falling
+// back to the other providers if it fails.
+func getWeather(ctx context.Context, lat, lon string) (Weather, error) {
+	var errs []error
+	for _, name := range weatherProviderOrder(weatherProvider) {
+		w, err := weatherProviders[name](ctx, lat, lon)
+		if err == nil {
+			w.Provider = name
+			return w, nil
+		}
+		if ctx.Err() != nil {
+			return Weather{}, err
+		}
+		slog.Warn("weather provider failed", "provider", name, "err", err)
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	return Weather{}, errors.Join(errs...)
+}
+
+func getOpenMeteoWeather(ctx context.Context, lat, lon string) (Weather, error) {
+	// The hourly times are returned in weatherTimezone, whose offset is in
+	// utc_offset_seconds.
+	url := fmt.Sprintf("%s/forecast?latitude=%s&longitude=%s"+
+		"&hourly=temperature_2m,relativehumidity_2m,apparent_temperature&timezone=%s",
+		weatherBaseURL, lat, lon, neturl.QueryEscape(weatherTimezone))
+	// Let open-meteo convert temperatures to avoid rounding differences with
+	// its own readings.
+	unit := celsius
+	if weatherForecastHours > 0 {
+		// Ask for enough days to cover the horizon from any hour of today.
+		url += fmt.Sprintf("&forecast_days=%d", min(weatherForecastHours/24+2, 16))
+	}
+	if temperatureUnit == fahrenheit {
+		url += "&temperature_unit=fahrenheit"
+		unit = fahrenheit
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Weather{}, fmt.Errorf("failed to create weather request: %w", err)
+	}
+	var rv struct {
+		UTCOffsetSeconds int `json:"utc_offset_seconds"`
+		Hourly           struct {
+			Time                []string   `json:"time"`
+			Temperature2m       []float64  `json:"temperature_2m"`
+			RelativeHumidity2m  []*float64 `json:"relativehumidity_2m"`
+			ApparentTemperature []*float64 `json:"apparent_temperature"`
+		} `json:"hourly"`
+	}
+	if err := fetchJSON(req, "weather", &rv); err != nil {
+		return Weather{}, err
+	}
+	if len(rv.Hourly.Temperature2m) == 0 {
+		return Weather{}, fmt.Errorf("no temperature data found")
+	}
+	if len(rv.Hourly.Time) != len(rv.Hourly.Temperature2m) {
+		return Weather{}, fmt.Errorf("mismatched weather data: %d times, %d temperatures",
+			len(rv.Hourly.Time), len(rv.Hourly.Temperature2m))
+	}
+	i, err := currentHourIndex(rv.Hourly.Time, time.FixedZone("", rv.UTCOffsetSeconds), time.Now())
+	if err != nil {
+		return Weather{}, err
+	}
+	w := Weather{
+		Unit:                unit,
+		Temperature:         rv.Hourly.Temperature2m[i],
+		Humidity:            valueAt(rv.Hourly.RelativeHumidity2m, i),
+		ApparentTemperature: valueAt(rv.Hourly.ApparentTemperature, i),
+	}
+	if h := weatherForecastHours; h > 0 {
+		if j := i + h; j < len(rv.Hourly.Temperature2m) {
+			w.Forecast = &rv.Hourly.Temperature2m[j]
+		} else {
+			slog.Warn("weather forecast horizon is past the returned data, recording the current weather only",
+				"horizon_hours", h, "forecast_hours", len(rv.Hourly.Temperature2m)-1-i)
+		}
+	}
+	return w, nil
+}
+
+// getMetNoWeather fetches the weather from met.no, which rejects requests
+// without an identifying User-Agent (see userAgent).
+func getMetNoWeather(ctx context.Context, lat, lon string) (Weather, error) {
+	url := fmt.Sprintf("%s/locationforecast/2.0/compact?lat=%s&lon=%s", metNoBaseURL, lat, lon)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Weather{}, fmt.Errorf("failed to create met.no request: %w", err)
+	}
+	var rv struct {
+		Properties struct {
+			Timeseries []struct {
+				Time time.Time `json:"time"`
+				Data struct {
+					Instant struct {
+						Details struct {
+							AirTemperature   *float64 `json:"air_temperature"`
+							RelativeHumidity *float64 `json:"relative_humidity"`
+						} `json:"details"`
+					} `json:"instant"`
+				} `json:"data"`
+			} `json:"timeseries"`
+		} `json:"properties"`
+	}
+	if err := fetchJSON(req, "met.no", &rv); err != nil {
+		return Weather{}, err
+	}
+	// timeseries is sorted by time; use the latest entry that is not in the
+	// future.
+	now := time.Now()
+	for i := len(rv.Properties.Timeseries) - 1; i >= 0; i-- {
+		ts := rv.Properties.Timeseries[i]
+		if ts.Time.After(now) || ts.Data.Instant.Details.AirTemperature == nil {
+			continue
+		}
+		return Weather{
+			Unit:        celsius,
+			Temperature: *ts.Data.Instant.Details.AirTemperature,
+			Humidity:    ts.Data.Instant.Details.RelativeHumidity,
+		}, nil
+	}
+	return Weather{}, fmt.Errorf("no temperature data found for the current hour")
+}
+
+// weatherMaxAttempts is the maximum number of attempts made for a request to
+// a weather provider, including the first one.
+var weatherMaxAttempts = defaultMaxAttempts
+
+// weatherLimiter limits the rate of requests to weather providers (all of them
+// combined), or is nil if unlimited.
+var weatherLimiter *rate.Limiter
+
+// fetchJSON sends req, retrying transient failures, and decodes the JSON
+// response into out. endpoint names the upstream in errors. Latencies are
+// recorded into weather_request_duration_ms.
+func fetchJSON(req *http.Request, endpoint string, out any) error {
+	return fetchJSONWithLatency(req, endpoint, weatherRequestDuration, out)
+}
+
+// fetchJSONWithLatency is fetchJSON, recording latencies into latency instead,
+// or not at all if nil.
+func fetchJSONWithLatency(req *http.Request, endpoint string, latency *stats.Float64Measure, out any) error {
+	resp, err := doWithRetry(req.Context(), httpClient, req, weatherMaxAttempts, weatherLimiter, latency)
+	if err != nil {
+		return wrapHTTPError(endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s request failed code=%d error=%s", endpoint, resp.StatusCode, string(body))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", endpoint, err)
+	}
+	return nil
+}
+
+// valueAt returns v[i], or nil if v is too short.
+func valueAt(v []*float64, i int) *float64 {
+	if i >= len(v) {
+		return nil
+	}
+	return v[i]
+}
+
+// currentHourIndex returns the index of the latest hourly timestamp that is not
+// after now, i.e. the current hour or, if missing, the nearest past hour.
+// Timestamps are in open-meteo's "2006-01-02T15:04" format in the given zone.
+func currentHourIndex(times []string, loc *time.Location, now time.Time) (int, error) {
+	idx := -1
+	for i, v := range times {
+		t, err := time.ParseInLocation("2006-01-02T15:04", v, loc)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse weather time %q: %w", v, err)
+		}
+		if t.After(now) {
+			break
+		}
+		idx = i
+	}
+	if idx < 0 {
+		return 0, fmt.Errorf("no temperature data found for the current hour")
+	}
+	return idx, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeOpenMeteo points weatherBaseURL at a server running handler for the
+// duration of the test.
+func fakeOpenMeteo(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	setVar(t, &weatherBaseURL, srv.URL)
+}
+
+// openMeteoHours returns open-meteo hourly times in loc for the previous,
+// current and next hour of now.
+func openMeteoHours(now time.Time, loc *time.Location) string {
+	h := now.In(loc).Truncate(time.Hour)
+	return fmt.Sprintf(`"%s","%s","%s"`, h.Add(-time.Hour).Format("2006-01-02T15:04"),
+		h.Format("2006-01-02T15:04"), h.Add(time.Hour).Format("2006-01-02T15:04"))
+}
+
+func TestGetOpenMeteoWeather(t *testing.T) {
+	setVar(t, &temperatureUnit, celsius)
+	setVar(t, &weatherForecastHours, 0)
+	var gotQuery string
+	fakeOpenMeteo(t, func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		fmt.Fprintf(w, `{"utc_offset_seconds":0,"hourly":{"time":[%s],"temperature_2m":[10.5,11.5,12.5],
+			"relativehumidity_2m":[60,null,70],"apparent_temperature":[9,10,11]}}`, openMeteoHours(time.Now(), time.UTC))
+	})
+
+	w, err := getOpenMeteoWeather(context.Background(), "47.68", "-122.38")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Temperature != 11.5 || w.Unit != celsius {
+		t.Errorf("temperature = %v%s, want 11.5C", w.Temperature, w.Unit)
+	}
+	if w.Humidity != nil {
+		t.Errorf("humidity = %v, want nil", *w.Humidity)
+	}
+	if a := w.ApparentTemperature; a == nil || *a != 10 {
+		t.Errorf("apparent temperature = %v, want 10", a)
+	}
+	if want := "latitude=47.68&longitude=-122.38"; !strings.Contains(gotQuery, want) {
+		t.Errorf("query %q does not contain %q", gotQuery, want)
+	}
+}
+
+func TestParseWeatherLocations(t *testing.T) {
+	got, err := parseWeatherLocations(" home:47.68, -122.38 ;cabin:46.85,-121.76;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []weatherLocation{
+		{Name: "home", Lat: "47.68", Lon: "-122.38"},
+		{Name: "cabin", Lat: "46.85", Lon: "-121.76"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, s := range []string{
+		"",                         // no locations
+		" ; ",                      // only separators
+		"47.68,-122.38",            // no name
+		":47.68,-122.38",           // empty name
+		"home:47.68",               // no longitude
+		"home;cabin:46.85,-121.76", // malformed first entry
+		"home:47.68,-122.38;cabin", // malformed last entry
+	} {
+		if got, err := parseWeatherLocations(s); err == nil {
+			t.Errorf("parseWeatherLocations(%q) = %+v, want an error", s, got)
+		}
+	}
+}
+
+func TestCurrentHourIndex(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	times := []string{"2024-05-01T10:00", "2024-05-01T11:00", "2024-05-01T12:00"}
+	for _, tt := range []struct {
+		now  time.Time
+		want int
+	}{
+		{time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC), 1}, // 11:30 local
+		{time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC), 1},  // on the hour
+		{time.Date(2024, 5, 1, 8, 59, 0, 0, time.UTC), 0},
+		{time.Date(2024, 5, 1, 15, 0, 0, 0, time.UTC), 2}, // past the data: latest hour
+	} {
+		got, err := currentHourIndex(times, loc, tt.now)
+		if err != nil || got != tt.want {
+			t.Errorf("currentHourIndex at %v = %d, %v, want %d", tt.now, got, err, tt.want)
+		}
+	}
+	if _, err := currentHourIndex(times, loc, time.Date(2024, 5, 1, 7, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("currentHourIndex before the data succeeded, want an error")
+	}
+	if _, err := currentHourIndex([]string{"11am"}, loc, time.Now()); err == nil {
+		t.Error("currentHourIndex of a malformed time succeeded, want an error")
+	}
+}
+
+func TestGetOpenMeteoWeatherLocalTimes(t *testing.T) {
+	setVar(t, &temperatureUnit, celsius)
+	setVar(t, &weatherForecastHours, 0)
+	setVar(t, &weatherTimezone, "auto")
+	tokyo := time.FixedZone("JST", 9*60*60)
+	var gotTimezone string
+	fakeOpenMeteo(t, func(w http.ResponseWriter, r *http.Request) {
+		gotTimezone = r.URL.Query().Get("timezone")
+		// Read as UTC, these times would all be in the future.
+		fmt.Fprintf(w, `{"utc_offset_seconds":32400,"hourly":{"time":[%s],"temperature_2m":[20,21,22]}}`,
+			openMeteoHours(time.Now(), tokyo))
+	})
+
+	w, err := getOpenMeteoWeather(context.Background(), "35.68", "139.69")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Temperature != 21 {
+		t.Errorf("temperature = %v, want 21 of the current local hour", w.Temperature)
+	}
+	if gotTimezone != "auto" {
+		t.Errorf("requested timezone %q, want auto", gotTimezone)
+	}
+}
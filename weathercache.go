@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Settings for carrying forward the last successful weather reading when a
+// fetch fails. The cache is disabled if weatherCacheFile is empty.
+var (
+	weatherCacheFile string
+	weatherCacheTTL  = time.Hour
+)
+
+type weatherCacheEntry struct {
+	Time    time.Time `json:"time"`
+	Weather Weather   `json:"weather"`
+}
+
+// saveWeatherCache writes w to path atomically, so that a crash mid-write
+// leaves the previous cache intact.
+func saveWeatherCache(path string, w Weather, now time.Time) error {
+	b, err := json.Marshal(weatherCacheEntry{Time: now, Weather: w})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, b); err != nil {
+		return fmt.Errorf("failed to write weather cache: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the contents of path with b through a temporary
+// file, so that readers never see a partial write. The file is readable by
+// all users, like with os.WriteFile, as other processes such as the textfile
+// collector of node_exporter may run as another user.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op after a successful rename
+	// CreateTemp uses 0600.
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// loadWeatherCache returns the cached weather in path if it is younger than
+// ttl.
+func loadWeatherCache(path string, ttl time.Duration, now time.Time) (Weather, bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Weather{}, false, nil
+		}
+		return Weather{}, false, fmt.Errorf("failed to read weather cache: %w", err)
+	}
+	var e weatherCacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return Weather{}, false, fmt.Errorf("failed to decode weather cache: %w", err)
+	}
+	if now.Sub(e.Time) > ttl {
+		return Weather{}, false, nil
+	}
+	return e.Weather, true, nil
+}